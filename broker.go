@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/shared"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	brokerStateMeasurement      = "mqtt_connection"
+	defaultMaxReconnectInterval = 60
+	defaultSessionStoreDir      = "./mqtt-store"
+	brokerConnectRetryInterval  = 5 * time.Second
+	brokerPublishTimeout        = 10 * time.Second
+)
+
+// brokerClient is a broker connection, whichever MQTT version it speaks
+type brokerClient interface {
+	Publish(topic string, qos byte, payload []byte) error
+	Disconnect()
+}
+
+// brokerSession keeps an MQTT connection up, resubscribing on every (re)connect and
+// reporting connection state changes to the log and the Telegraf channel
+type brokerSession struct {
+	ctx             context.Context
+	name            string
+	topics          map[string]shared.PluginConfigs
+	sharedGroup     string
+	telegrafChannel chan shared.TelegrafChannelMessage
+	reconnects      atomic.Int64
+}
+
+func connectBroker(ctx context.Context, cfg shared.BrokerConfig, handler mqtt.MessageHandler, telegrafChannel chan shared.TelegrafChannelMessage) (brokerClient, error) {
+	s := &brokerSession{
+		ctx:             ctx,
+		name:            cfg.Name,
+		topics:          cfg.Topics,
+		sharedGroup:     cfg.SharedGroup,
+		telegrafChannel: telegrafChannel,
+	}
+
+	switch cfg.Protocol {
+	case "", "3", "3.1.1":
+		return s.connectV3(cfg, handler)
+	case "5":
+		return s.connectV5(cfg, handler)
+	default:
+		return nil, fmt.Errorf("unknown MQTT protocol [%s] for broker [%s]", cfg.Protocol, cfg.Name)
+	}
+}
+
+// mqtt3Client is an MQTT 3.1.1 broker connection
+type mqtt3Client struct {
+	client mqtt.Client
+}
+
+func (c mqtt3Client) Publish(topic string, qos byte, payload []byte) error {
+	token := c.client.Publish(topic, qos, false, payload)
+	if !token.WaitTimeout(brokerPublishTimeout) {
+		return fmt.Errorf("publish to [%s] timed out", topic)
+	}
+	return token.Error()
+}
+
+func (c mqtt3Client) Disconnect() {
+	c.client.Disconnect(250)
+}
+
+func (s *brokerSession) connectV3(cfg shared.BrokerConfig, handler mqtt.MessageHandler) (brokerClient, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.URL)
+	opts.SetClientID(cfg.ClientID)
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	opts.SetDefaultPublishHandler(handler)
+
+	brokerTLS, err := brokerTLSConfig(cfg.URL, cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup TLS for broker [%s]: %w", cfg.Name, err)
+	}
+	if brokerTLS != nil {
+		opts.SetTLSConfig(brokerTLS)
+	}
+
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(brokerConnectRetryInterval)
+	opts.SetMaxReconnectInterval(maxReconnectInterval(cfg.Session))
+
+	if cfg.Session.PersistentSession {
+		if cfg.ClientID == "" {
+			return nil, fmt.Errorf("a persistent MQTT session needs a fixed clientID, broker [%s]", cfg.Name)
+		}
+		dir := sessionStoreDir(cfg)
+		opts.SetCleanSession(false)
+		opts.SetStore(mqtt.NewFileStore(dir))
+		log.Infof("persistent MQTT session for [%s], in-flight messages stored in [%s]", cfg.Name, dir)
+	}
+
+	opts.SetOnConnectHandler(s.onConnect)
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		s.connectionLost(err)
+	})
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		s.reconnecting()
+	})
+
+	client := mqtt.NewClient(opts)
+
+	// with ConnectRetry the token only completes once connected, so do not block startup
+	// on an unreachable broker
+	token := client.Connect()
+	if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return mqtt3Client{client: client}, nil
+}
+
+// onConnect (re)subscribes every configured topic, the broker may have lost them
+func (s *brokerSession) onConnect(client mqtt.Client) {
+	s.connected()
+
+	token := client.SubscribeMultiple(s.subscriptions(), nil)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Errorf("Subscription error on [%s]: %s", s.name, token.Error())
+		}
+	}()
+}
+
+// subscriptions returns the topic filters to subscribe with their QoS
+func (s *brokerSession) subscriptions() map[string]byte {
+	filters := make(map[string]byte)
+	for topic, plugs := range s.topics {
+		filter := topic
+		if s.sharedGroup != "" {
+			filter = fmt.Sprintf("$share/%s/%s", s.sharedGroup, topic)
+		}
+		filters[filter] = plugs.QoS()
+		log.Infof("[%s] subscribed to topic: ['%s'] with Qos: [%d]", s.name, filter, filters[filter])
+	}
+	return filters
+}
+
+func (s *brokerSession) connected() {
+	log.Infof("connected to MQTT broker [%s]", s.name)
+	s.report("connected")
+}
+
+func (s *brokerSession) connectionLost(err error) {
+	log.Warnf("connection to MQTT broker [%s] lost: %s", s.name, err)
+	s.report("lost")
+}
+
+func (s *brokerSession) reconnecting() {
+	s.reconnects.Add(1)
+	log.Infof("reconnecting to MQTT broker [%s]", s.name)
+	s.report("reconnecting")
+}
+
+// report sends the connection state to Telegraf
+func (s *brokerSession) report(state string) {
+	connected := int64(0)
+	if state == "connected" {
+		connected = 1
+	}
+
+	point := metrics.Point{
+		Measurement: brokerStateMeasurement,
+		Tags:        map[string]string{"broker": s.name},
+		Fields: map[string]interface{}{
+			"state":      state,
+			"connected":  connected,
+			"reconnects": s.reconnects.Load(),
+		},
+		Time: time.Now(),
+	}
+
+	select {
+	case s.telegrafChannel <- point:
+	case <-s.ctx.Done():
+	}
+}
+
+func maxReconnectInterval(cfg shared.BrokerSessionConfig) time.Duration {
+	if cfg.MaxReconnectInterval == 0 {
+		return defaultMaxReconnectInterval * time.Second
+	}
+	return time.Duration(cfg.MaxReconnectInterval) * time.Second
+}
+
+// sessionStoreDir returns <store_dir>/<broker name>, brokers sharing a store_dir must not
+// share their in-flight messages
+func sessionStoreDir(cfg shared.BrokerConfig) string {
+	dir := cfg.Session.StoreDir
+	if dir == "" {
+		dir = defaultSessionStoreDir
+	}
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			return r
+		}
+		return '_'
+	}, cfg.Name)
+	return filepath.Join(dir, name)
+}
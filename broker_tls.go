@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gomqttenc/shared"
+	"net/url"
+	"os"
+
+	"github.com/charmbracelet/log"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// broker URL schemes that paho dials over TLS
+var tlsBrokerSchemes = map[string]bool{
+	"ssl":      true,
+	"tls":      true,
+	"mqtts":    true,
+	"mqtt+ssl": true,
+	"tcps":     true,
+	"wss":      true,
+}
+
+// brokerTLSConfig builds the TLS config of a broker connection. It returns nil for plain
+// tcp:// and ws:// brokers.
+func brokerTLSConfig(broker string, cfg shared.BrokerTLSConfig) (*tls.Config, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL [%s]: %w", broker, err)
+	}
+
+	if !tlsBrokerSchemes[u.Scheme] {
+		if cfg != (shared.BrokerTLSConfig{}) {
+			log.Warnf("broker_tls is ignored for [%s], use an ssl://, mqtts:// or wss:// URL", broker)
+		}
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.InsecureSkipVerify {
+		log.Warnf("TLS certificate verification disabled for broker [%s]", broker)
+	}
+
+	if cfg.CACert != "" {
+		caCert, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load broker CA file: %w", err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in broker CA file [%s]", cfg.CACert)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	switch {
+	case cfg.PKCS12 != "":
+		pfx, err := os.ReadFile(cfg.PKCS12)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load broker PKCS12 file: %w", err)
+		}
+		key, leaf, chain, err := pkcs12.DecodeChain(pfx, cfg.Passwd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode broker PKCS12 file: %w", err)
+		}
+		cert := tls.Certificate{
+			PrivateKey:  key,
+			Certificate: [][]byte{leaf.Raw},
+			Leaf:        leaf,
+		}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case cfg.Cert != "" || cfg.Key != "":
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load broker client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gomqttenc/shared"
+	"net/url"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqtt5KeepAlive             = 30
+	mqtt5SessionExpiryInterval = 24 * 60 * 60
+)
+
+// mqtt5Client is an MQTT v5 broker connection
+type mqtt5Client struct {
+	cm *autopaho.ConnectionManager
+}
+
+func (c mqtt5Client) Publish(topic string, qos byte, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), brokerPublishTimeout)
+	defer cancel()
+
+	_, err := c.cm.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Payload: payload,
+	})
+	return err
+}
+
+func (c mqtt5Client) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	if err := c.cm.Disconnect(ctx); err != nil {
+		log.Debugf("MQTT v5 disconnect: %s", err)
+	}
+}
+
+func (s *brokerSession) connectV5(cfg shared.BrokerConfig, handler mqtt.MessageHandler) (brokerClient, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL [%s]: %w", cfg.URL, err)
+	}
+
+	brokerTLS, err := brokerTLSConfig(cfg.URL, cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup TLS for broker [%s]: %w", cfg.Name, err)
+	}
+
+	backoff := autopaho.NewConstantBackoff(brokerConnectRetryInterval)
+	if maxDelay := maxReconnectInterval(cfg.Session); maxDelay > brokerConnectRetryInterval {
+		backoff = autopaho.NewExponentialBackoff(time.Second, maxDelay, brokerConnectRetryInterval, 2)
+	}
+
+	cliCfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		TlsCfg:                        brokerTLS,
+		KeepAlive:                     mqtt5KeepAlive,
+		CleanStartOnInitialConnection: !cfg.Session.PersistentSession,
+		ReconnectBackoff:              backoff,
+		ConnectUsername:               cfg.Username,
+		ConnectPassword:               []byte(cfg.Password),
+
+		// autopaho callbacks must not block, the state report waits for the Telegraf channel
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			go s.connected()
+			go s.subscribeV5(cm)
+		},
+		OnConnectionDown: func() bool {
+			go s.connectionLost(fmt.Errorf("connection down"))
+			return true
+		},
+		OnConnectError: func(err error) {
+			log.Warnf("MQTT broker [%s] connect failed: %s", s.name, err)
+			go s.reconnecting()
+		},
+
+		ClientConfig: paho.ClientConfig{
+			ClientID: cfg.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					handler(nil, v5Message(pr.Packet))
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				log.Warnf("MQTT broker [%s] client error: %s", s.name, err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				log.Warnf("MQTT broker [%s] disconnected us, reason code [%d]", s.name, d.ReasonCode)
+			},
+		},
+	}
+
+	if cfg.Session.PersistentSession {
+		if cfg.ClientID == "" {
+			return nil, fmt.Errorf("a persistent MQTT session needs a fixed clientID, broker [%s]", cfg.Name)
+		}
+		dir := sessionStoreDir(cfg)
+		clientStore, err := file.New(dir, "client-", ".pkt")
+		if err != nil {
+			return nil, err
+		}
+		serverStore, err := file.New(dir, "server-", ".pkt")
+		if err != nil {
+			return nil, err
+		}
+		cliCfg.SessionExpiryInterval = mqtt5SessionExpiryInterval
+		cliCfg.Session = state.New(clientStore, serverStore)
+		log.Infof("persistent MQTT session for [%s], in-flight messages stored in [%s]", cfg.Name, dir)
+	}
+
+	cm, err := autopaho.NewConnection(s.ctx, cliCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// like the 3.1.1 client, keep retrying in the background if the broker is not there yet
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		log.Warnf("MQTT broker [%s] not connected yet: %s", cfg.Name, err)
+	}
+
+	return mqtt5Client{cm: cm}, nil
+}
+
+func (s *brokerSession) subscribeV5(cm *autopaho.ConnectionManager) {
+	sub := &paho.Subscribe{}
+	for filter, qos := range s.subscriptions() {
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: filter, QoS: qos})
+	}
+
+	if _, err := cm.Subscribe(s.ctx, sub); err != nil {
+		log.Errorf("Subscription error on [%s]: %s", s.name, err)
+	}
+}
+
+// v5Message adapts a v5 publish to the message type the plugins take
+func v5Message(p *paho.Publish) *shared.V5Message {
+	msg := &shared.V5Message{
+		LocalMessage: shared.LocalMessage{TopicName: p.Topic, Body: p.Payload},
+		QoS:          p.QoS,
+		Retain:       p.Retain,
+		PacketID:     p.PacketID,
+	}
+
+	if p.Properties != nil && len(p.Properties.User) > 0 {
+		msg.Properties = make(map[string]string, len(p.Properties.User))
+		for _, prop := range p.Properties.User {
+			// the first value wins when a key is repeated, like UserProperties.Get
+			if _, ok := msg.Properties[prop.Key]; !ok {
+				msg.Properties[prop.Key] = prop.Value
+			}
+		}
+	}
+
+	return msg
+}
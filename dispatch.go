@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/shared"
+	"gomqttenc/utils"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	overflowBlock      = "block"
+	overflowDropNewest = "drop_newest"
+	overflowDropOldest = "drop_oldest"
+
+	defaultDispatchWorkers   = 4
+	defaultDispatchQueueSize = 1024
+	defaultDispatchDrain     = 10
+	dispatchMeasurement      = "gomqttenc_dispatch"
+	dispatchReportInterval   = time.Minute
+)
+
+type queuedMessage struct {
+	handler mqtt.MessageHandler
+	client  mqtt.Client
+	msg     mqtt.Message
+}
+
+// dispatcher decouples the MQTT callbacks and inputs from the plugins. Messages are sharded
+// over the workers by source node so the packets of one node are processed in order.
+type dispatcher struct {
+	queues   []chan queuedMessage
+	overflow string
+	drain    time.Duration
+	wg       sync.WaitGroup
+
+	// enqueue holds the read lock while sending so close never closes a queue under it
+	mu     sync.RWMutex
+	closed bool
+
+	enqueued  atomic.Int64
+	processed atomic.Int64
+	dropped   atomic.Int64
+	blocked   atomic.Int64
+}
+
+func newDispatcher(cfg shared.DispatchConfig) (*dispatcher, error) {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = defaultDispatchWorkers
+	}
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultDispatchQueueSize
+	}
+	drain := cfg.DrainTimeout
+	if drain <= 0 {
+		drain = defaultDispatchDrain
+	}
+
+	d := &dispatcher{
+		queues:   make([]chan queuedMessage, workers),
+		overflow: cfg.Overflow,
+		drain:    time.Duration(drain) * time.Second,
+	}
+	switch d.overflow {
+	case "":
+		d.overflow = overflowBlock
+	case overflowBlock, overflowDropNewest, overflowDropOldest:
+	default:
+		return nil, fmt.Errorf("unknown dispatch overflow policy [%s]", cfg.Overflow)
+	}
+
+	// each worker owns a shard of the queue
+	perWorker := max(size/workers, 1)
+	for i := range d.queues {
+		d.queues[i] = make(chan queuedMessage, perWorker)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	log.Infof("dispatch: [%d] workers, queue [%d] per worker, overflow [%s]", workers, perWorker, d.overflow)
+
+	return d, nil
+}
+
+// wrap returns a handler that queues messages for handler instead of running it inline
+func (d *dispatcher) wrap(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		d.enqueue(queuedMessage{handler: handler, client: client, msg: msg})
+	}
+}
+
+func (d *dispatcher) enqueue(qm queuedMessage) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		d.dropped.Add(1)
+		log.Debugf("dispatch: closed, dropping [%s]", qm.msg.Topic())
+		return
+	}
+
+	queue := d.queues[shardKey(qm.msg)%uint32(len(d.queues))]
+
+	select {
+	case queue <- qm:
+		d.enqueued.Add(1)
+		return
+	default:
+	}
+
+	switch d.overflow {
+	case overflowDropNewest:
+		d.dropped.Add(1)
+		log.Warnf("dispatch: queue full, dropping [%s]", qm.msg.Topic())
+	case overflowDropOldest:
+		for {
+			select {
+			case queue <- qm:
+				d.enqueued.Add(1)
+				return
+			default:
+			}
+			select {
+			case old := <-queue:
+				d.dropped.Add(1)
+				log.Warnf("dispatch: queue full, dropping oldest [%s]", old.msg.Topic())
+			default:
+			}
+		}
+	default:
+		d.blocked.Add(1)
+		queue <- qm
+		d.enqueued.Add(1)
+	}
+}
+
+func (d *dispatcher) work(queue chan queuedMessage) {
+	defer d.wg.Done()
+	for qm := range queue {
+		qm.handler(qm.client, qm.msg)
+		d.processed.Add(1)
+	}
+}
+
+// close stops accepting messages and waits for the queued ones to be processed. Message
+// sources must be stopped before calling it.
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, q := range d.queues {
+			close(q)
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Infof("dispatch: drained, [%d] messages processed", d.processed.Load())
+	case <-time.After(d.drain):
+		log.Warnf("dispatch: drain timed out with [%d] messages queued", d.depth())
+	}
+}
+
+func (d *dispatcher) depth() int {
+	depth := 0
+	for _, q := range d.queues {
+		depth += len(q)
+	}
+	return depth
+}
+
+// report sends the dispatch counters to Telegraf until ctx is cancelled
+func (d *dispatcher) report(ctx context.Context, telegrafChannel chan shared.TelegrafChannelMessage) {
+	ticker := time.NewTicker(dispatchReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			point := metrics.Point{
+				Measurement: dispatchMeasurement,
+				Tags:        map[string]string{"overflow": d.overflow},
+				Fields: map[string]interface{}{
+					"enqueued":    d.enqueued.Load(),
+					"processed":   d.processed.Load(),
+					"dropped":     d.dropped.Load(),
+					"blocked":     d.blocked.Load(),
+					"queue_depth": int64(d.depth()),
+				},
+				Time: now,
+			}
+			select {
+			case telegrafChannel <- point:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// shardKey picks the source node of a message: the packet sender of Meshtastic envelopes
+// and packets, the device of JSON events, and the topic otherwise
+func shardKey(msg mqtt.Message) uint32 {
+	payload := msg.Payload()
+
+	if utils.IsLikelyJSON(payload) {
+		var event struct {
+			From  uint32          `json:"from"`
+			Model string          `json:"model"`
+			ID    json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(payload, &event); err == nil {
+			if event.From != 0 {
+				return event.From
+			}
+			if event.Model != "" {
+				return hashKey(event.Model + "/" + string(event.ID))
+			}
+		}
+		return hashKey(msg.Topic())
+	}
+
+	var env meshtastic.ServiceEnvelope
+	if err := proto.Unmarshal(payload, &env); err == nil && env.GetPacket().GetFrom() != 0 {
+		return env.GetPacket().GetFrom()
+	}
+	var packet meshtastic.MeshPacket
+	if err := proto.Unmarshal(payload, &packet); err == nil && packet.GetFrom() != 0 {
+		return packet.GetFrom()
+	}
+
+	return hashKey(msg.Topic())
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
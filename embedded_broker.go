@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"gomqttenc/shared"
+	"gomqttenc/utils"
+	"log/slog"
+	"sort"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	listenerTCP       = "tcp"
+	listenerWebSocket = "ws"
+
+	embeddedBridgeQueue = 1024
+)
+
+// access rights of an embedded broker ACL entry
+const (
+	aclRead      = "r"
+	aclWrite     = "w"
+	aclReadWrite = "rw"
+	aclDeny      = "deny"
+)
+
+// startEmbeddedBroker runs an in-process MQTT broker. Published messages are dispatched
+// by handler and forwarded to the upstream brokers of the configured bridges.
+func startEmbeddedBroker(ctx context.Context, cfg shared.EmbeddedBrokerConfig, handler mqtt.MessageHandler, clients map[string]brokerClient) (*mochi.Server, error) {
+	server := mochi.New(&mochi.Options{
+		Logger: slog.New(log.Default()),
+	})
+
+	hook, err := newEmbeddedBrokerHook(ctx, cfg, handler, clients)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.AddHook(hook, nil); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Listeners) == 0 {
+		return nil, fmt.Errorf("embedded broker has no listeners")
+	}
+	for i, l := range cfg.Listeners {
+		lc := listeners.Config{
+			ID:      fmt.Sprintf("%s-%d", l.Type, i),
+			Address: l.Address,
+		}
+		if l.Cert != "" || l.Key != "" {
+			cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load certificate of listener [%s]: %w", l.Address, err)
+			}
+			lc.TLSConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			}
+		}
+
+		var listener listeners.Listener
+		switch l.Type {
+		case listenerTCP:
+			listener = listeners.NewTCP(lc)
+		case listenerWebSocket:
+			listener = listeners.NewWebsocket(lc)
+		default:
+			return nil, fmt.Errorf("unknown embedded broker listener type [%s]", l.Type)
+		}
+		if err := server.AddListener(listener); err != nil {
+			return nil, err
+		}
+		log.Infof("embedded broker listening on [%s] [%s] tls [%v]", l.Type, l.Address, lc.TLSConfig != nil)
+	}
+
+	if err := server.Serve(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// embeddedBridge forwards matching topics to an upstream broker. Messages are queued so a
+// slow upstream never stalls the radios publishing to the embedded broker.
+type embeddedBridge struct {
+	name   string
+	client brokerClient
+	topics []string
+	qos    byte
+	queue  chan *shared.LocalMessage
+}
+
+func (b *embeddedBridge) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-b.queue:
+			if err := b.client.Publish(msg.TopicName, b.qos, msg.Body); err != nil {
+				log.Warnf("embedded broker: forwarding [%s] to [%s] failed: %s", msg.TopicName, b.name, err)
+			}
+		}
+	}
+}
+
+// embeddedBrokerHook authenticates clients, enforces ACLs and hands published messages
+// to the plugin dispatch and the bridges
+type embeddedBrokerHook struct {
+	mochi.HookBase
+	handler        mqtt.MessageHandler
+	allowAnonymous bool
+	anonymousACL   []aclEntry
+	users          map[string]brokerUser
+	bridges        []*embeddedBridge
+}
+
+type brokerUser struct {
+	password string
+	acl      []aclEntry
+}
+
+type aclEntry struct {
+	filter string
+	access string
+}
+
+func newEmbeddedBrokerHook(ctx context.Context, cfg shared.EmbeddedBrokerConfig, handler mqtt.MessageHandler, clients map[string]brokerClient) (*embeddedBrokerHook, error) {
+	h := &embeddedBrokerHook{
+		handler:        handler,
+		allowAnonymous: cfg.AllowAnonymous,
+		users:          make(map[string]brokerUser),
+	}
+
+	var err error
+	if h.anonymousACL, err = parseACL(cfg.AnonymousACL); err != nil {
+		return nil, err
+	}
+	for _, u := range cfg.Users {
+		acl, err := parseACL(u.ACL)
+		if err != nil {
+			return nil, fmt.Errorf("user [%s]: %w", u.Username, err)
+		}
+		h.users[u.Username] = brokerUser{password: u.Password, acl: acl}
+	}
+
+	for _, bc := range cfg.Bridges {
+		client, ok := clients[bc.Broker]
+		if !ok {
+			return nil, fmt.Errorf("embedded broker bridge to unknown broker [%s]", bc.Broker)
+		}
+		bridge := &embeddedBridge{
+			name:   bc.Broker,
+			client: client,
+			topics: bc.Topics,
+			qos:    bc.QoS,
+			queue:  make(chan *shared.LocalMessage, embeddedBridgeQueue),
+		}
+		go bridge.run(ctx)
+		h.bridges = append(h.bridges, bridge)
+		log.Infof("embedded broker bridges %v to [%s]", bc.Topics, bc.Broker)
+	}
+
+	return h, nil
+}
+
+func (h *embeddedBrokerHook) ID() string {
+	return "gomqttenc"
+}
+
+func (h *embeddedBrokerHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mochi.OnConnectAuthenticate,
+		mochi.OnACLCheck,
+		mochi.OnPublished,
+	}, []byte{b})
+}
+
+func (h *embeddedBrokerHook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	username := string(cl.Properties.Username)
+	if username == "" {
+		return h.allowAnonymous
+	}
+
+	user, ok := h.users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(user.password), pk.Connect.Password) != 1 {
+		log.Warnf("embedded broker: authentication failed for [%s] from [%s]", username, cl.Net.Remote)
+		return false
+	}
+	return true
+}
+
+func (h *embeddedBrokerHook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	acl := h.anonymousACL
+	if username := string(cl.Properties.Username); username != "" {
+		acl = h.users[username].acl
+	}
+	if len(acl) == 0 {
+		return true
+	}
+
+	for _, e := range acl {
+		if !utils.TopicMatches(e.filter, topic) {
+			continue
+		}
+		switch e.access {
+		case aclReadWrite:
+			return true
+		case aclRead:
+			return !write
+		case aclWrite:
+			return write
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func (h *embeddedBrokerHook) OnPublished(cl *mochi.Client, pk packets.Packet) {
+	msg := &shared.V5Message{
+		LocalMessage: shared.LocalMessage{TopicName: pk.TopicName, Body: pk.Payload},
+		QoS:          pk.FixedHeader.Qos,
+		Retain:       pk.FixedHeader.Retain,
+		PacketID:     pk.PacketID,
+	}
+	if len(pk.Properties.User) > 0 {
+		msg.Properties = make(map[string]string, len(pk.Properties.User))
+		for _, prop := range pk.Properties.User {
+			if _, ok := msg.Properties[prop.Key]; !ok {
+				msg.Properties[prop.Key] = prop.Val
+			}
+		}
+	}
+
+	for _, b := range h.bridges {
+		for _, filter := range b.topics {
+			if !utils.TopicMatches(filter, pk.TopicName) {
+				continue
+			}
+			select {
+			case b.queue <- &msg.LocalMessage:
+			default:
+				log.Warnf("embedded broker: bridge to [%s] is full, dropping [%s]", b.name, pk.TopicName)
+			}
+			break
+		}
+	}
+
+	h.handler(nil, msg)
+}
+
+// parseACL validates an ACL and orders it so the most specific filter is checked first
+func parseACL(acl map[string]string) ([]aclEntry, error) {
+	entries := make([]aclEntry, 0, len(acl))
+	for filter, access := range acl {
+		switch access {
+		case aclRead, aclWrite, aclReadWrite, aclDeny:
+		default:
+			return nil, fmt.Errorf("invalid access [%s] for [%s], use r, w, rw or deny", access, filter)
+		}
+		entries = append(entries, aclEntry{filter: filter, access: access})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if len(entries[i].filter) != len(entries[j].filter) {
+			return len(entries[i].filter) > len(entries[j].filter)
+		}
+		return entries[i].filter < entries[j].filter
+	})
+	return entries, nil
+}
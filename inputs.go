@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gomqttenc/radio"
+	"gomqttenc/rtl433"
+	"gomqttenc/shared"
+	"gomqttenc/tak"
+	"io"
+	"time"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	inputTCP    = "tcp"
+	inputSerial = "serial"
+	inputUDP    = "udp_multicast"
+
+	inputRTL433HTTP      = "rtl433_http"
+	inputRTL433WebSocket = "rtl433_ws"
+	inputRTL433Syslog    = "rtl433_syslog"
+
+	defaultRadioTopic     = "msh/udp/radio"
+	defaultMulticastTopic = "msh/udp/multicast"
+	defaultRTL433Topic    = "rtl_433/collector/events"
+	inputMinBackoff       = 2 * time.Second
+	inputMaxBackoff       = time.Minute
+)
+
+var inputTypes = map[string]bool{
+	inputTCP:             true,
+	inputSerial:          true,
+	inputUDP:             true,
+	inputRTL433HTTP:      true,
+	inputRTL433WebSocket: true,
+	inputRTL433Syslog:    true,
+}
+
+// startInputs starts every configured non-MQTT input. Their messages go through the same
+// handler, and therefore the same plugins, as messages received from the broker. Every
+// input type is checked before any input starts.
+func startInputs(ctx context.Context, inputs []shared.InputConfig, handler mqtt.MessageHandler, identities *tak.IdentityRegistry) {
+	for _, in := range inputs {
+		if !inputTypes[in.Type] {
+			log.Fatalf("unknown input type [%s] for [%s]", in.Type, in.Address)
+		}
+	}
+
+	for _, in := range inputs {
+		switch in.Type {
+		case inputTCP:
+			go runRadioInput(ctx, in, handler, identities, func(ctx context.Context) (io.ReadWriteCloser, error) {
+				return radio.DialTCP(ctx, in.Address)
+			})
+		case inputSerial:
+			go runRadioInput(ctx, in, handler, identities, func(ctx context.Context) (io.ReadWriteCloser, error) {
+				return radio.OpenSerial(in.Address, in.Baud)
+			})
+		case inputUDP:
+			go runMulticastInput(ctx, in, handler)
+		case inputRTL433HTTP:
+			go runRTL433Input(ctx, in, handler, rtl433.StreamHTTP)
+		case inputRTL433WebSocket:
+			go runRTL433Input(ctx, in, handler, rtl433.StreamWebSocket)
+		case inputRTL433Syslog:
+			go runRTL433Input(ctx, in, handler, rtl433.ListenSyslog)
+		}
+		log.Infof("Input: [%s] [%s] => topic [%s]", in.Type, in.Address, inputTopic(in))
+	}
+}
+
+// runRadioInput keeps a streaming API session to a radio open, reconnecting with backoff
+func runRadioInput(ctx context.Context, in shared.InputConfig, handler mqtt.MessageHandler, identities *tak.IdentityRegistry, open func(context.Context) (io.ReadWriteCloser, error)) {
+	name := fmt.Sprintf("%s:%s", in.Type, in.Address)
+	topic := inputTopic(in)
+	backoff := inputMinBackoff
+
+	for {
+		conn, err := open(ctx)
+		if err != nil {
+			log.Warnf("radio [%s]: connect failed: %s", name, err)
+		} else {
+			log.Infof("radio [%s]: connected", name)
+			backoff = inputMinBackoff
+
+			session := radio.NewSession(name, conn, radio.Handlers{
+				Packet: func(packet *meshtastic.MeshPacket) {
+					dispatchMeshPacket(handler, topic, packet)
+				},
+				NodeInfo: func(info *meshtastic.NodeInfo) {
+					if user := info.GetUser(); user != nil {
+						identities.Learn(info.GetNum(), user.GetLongName(), user.GetShortName())
+					}
+				},
+			})
+			err = session.Run(ctx)
+			log.Warnf("radio [%s]: session ended: %s", name, err)
+		}
+
+		if !waitBackoff(ctx, backoff) {
+			log.Infof("radio [%s]: shutting down", name)
+			return
+		}
+		backoff = min(backoff*2, inputMaxBackoff)
+	}
+}
+
+// runMulticastInput listens on the Meshtastic UDP multicast group
+func runMulticastInput(ctx context.Context, in shared.InputConfig, handler mqtt.MessageHandler) {
+	topic := inputTopic(in)
+
+	runWithBackoff(ctx, "multicast "+in.Address, func(ctx context.Context) error {
+		return radio.ListenMulticast(ctx, in.Address, in.Interface, func(payload []byte, packet *meshtastic.MeshPacket) {
+			log.Debugf("multicast: packet [%x] from [%x]", packet.GetId(), packet.GetFrom())
+			handler(nil, &shared.LocalMessage{TopicName: topic, Body: payload})
+		})
+	})
+}
+
+// runRTL433Input feeds JSON events read directly from rtl_433 to the rtl_433 plugin
+func runRTL433Input(ctx context.Context, in shared.InputConfig, handler mqtt.MessageHandler, read func(context.Context, string, func([]byte)) error) {
+	topic := inputTopic(in)
+
+	runWithBackoff(ctx, in.Type+" "+in.Address, func(ctx context.Context) error {
+		return read(ctx, in.Address, func(event []byte) {
+			handler(nil, &shared.LocalMessage{TopicName: topic, Body: event})
+		})
+	})
+}
+
+// runWithBackoff restarts a blocking input until ctx is cancelled
+func runWithBackoff(ctx context.Context, name string, run func(context.Context) error) {
+	backoff := inputMinBackoff
+
+	for {
+		start := time.Now()
+		err := run(ctx)
+		if ctx.Err() == nil {
+			log.Warnf("input [%s] stopped: %s", name, err)
+		}
+		if time.Since(start) > inputMaxBackoff {
+			backoff = inputMinBackoff
+		}
+
+		if !waitBackoff(ctx, backoff) {
+			log.Infof("input [%s]: shutting down", name)
+			return
+		}
+		backoff = min(backoff*2, inputMaxBackoff)
+	}
+}
+
+// dispatchMeshPacket hands a raw MeshPacket to the plugin registered for topic
+func dispatchMeshPacket(handler mqtt.MessageHandler, topic string, packet *meshtastic.MeshPacket) {
+	payload, err := proto.Marshal(packet)
+	if err != nil {
+		log.Errorf("failed to marshal MeshPacket from [%x]: %s", packet.GetFrom(), err)
+		return
+	}
+	handler(nil, &shared.LocalMessage{TopicName: topic, Body: payload})
+}
+
+// inputTopic returns the topic whose plugin handles an input's messages
+func inputTopic(in shared.InputConfig) string {
+	switch {
+	case in.Topic != "":
+		return in.Topic
+	case in.Type == inputUDP:
+		return defaultMulticastTopic
+	case in.Type == inputRTL433HTTP || in.Type == inputRTL433WebSocket || in.Type == inputRTL433Syslog:
+		return defaultRTL433Topic
+	default:
+		return defaultRadioTopic
+	}
+}
+
+// waitBackoff sleeps for d and reports false if ctx was cancelled meanwhile
+func waitBackoff(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"gomqttenc/radio"
+	"gomqttenc/shared"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+// pluggedRadio returns the host end of a radio that sends one packet, after some console
+// output, and is then unplugged
+func pluggedRadio(t *testing.T, id uint32) io.ReadWriteCloser {
+	t.Helper()
+	payload, err := proto.Marshal(&meshtastic.FromRadio{
+		PayloadVariant: &meshtastic.FromRadio_Packet{Packet: &meshtastic.MeshPacket{From: 7, Id: id}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := []byte{radio.Start1, radio.Start2, 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	frame = append(frame, payload...)
+
+	host, dev := net.Pipe()
+	go func() {
+		defer dev.Close()
+		go func() { _, _ = io.Copy(io.Discard, dev) }()
+		_, _ = dev.Write(append([]byte("INFO | ready\n"), frame...))
+	}()
+	return host
+}
+
+// TestRunRadioInputReconnect checks that a radio input opens the device again after it
+// disappears and keeps failing to open
+func TestRunRadioInputReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan mqtt.Message, 4)
+	handler := func(_ mqtt.Client, msg mqtt.Message) { received <- msg }
+
+	// the device comes back after a failed open
+	devices := []io.ReadWriteCloser{pluggedRadio(t, 1), nil, pluggedRadio(t, 2)}
+	open := func(context.Context) (io.ReadWriteCloser, error) {
+		if len(devices) == 0 || devices[0] == nil {
+			if len(devices) > 0 {
+				devices = devices[1:]
+			}
+			return nil, errors.New("no such device")
+		}
+		dev := devices[0]
+		devices = devices[1:]
+		return dev, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runRadioInput(ctx, shared.InputConfig{Type: inputSerial, Address: "/dev/ttyFAKE0"}, handler, nil, open)
+	}()
+
+	timeout := time.After(4*inputMinBackoff + 5*time.Second)
+	for _, want := range []uint32{1, 2} {
+		select {
+		case msg := <-received:
+			var packet meshtastic.MeshPacket
+			if err := proto.Unmarshal(msg.Payload(), &packet); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Topic() != defaultRadioTopic || packet.GetId() != want {
+				t.Fatalf("packet %d on [%s], want %d on [%s]", packet.GetId(), msg.Topic(), want, defaultRadioTopic)
+			}
+		case <-timeout:
+			t.Fatalf("packet %d not received after reconnecting", want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("input did not stop after cancel")
+	}
+}
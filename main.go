@@ -6,7 +6,11 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"flag"
+	"gomqttenc/position"
+	"gomqttenc/rtl433"
 	"gomqttenc/shared"
+	"gomqttenc/tak"
+	"gomqttenc/transform"
 	"gomqttenc/utils"
 	"os"
 	"os/signal"
@@ -14,7 +18,7 @@ import (
 	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
 	pkcs12 "software.sslmate.com/src/go-pkcs12"
 
 	"github.com/charmbracelet/log"
@@ -113,16 +117,10 @@ func main() {
 	log.Printf("client cert chain length: %d", len(tlsConfig.Certificates[0].Certificate))
 	log.Printf("RootCAs set: %v", tlsConfig.RootCAs != nil)
 
-	// Load Plugins
-	var MqttPluginHandlers = make(shared.MqttPluginHandlers)
-
-	for t, p := range cfg.Topics {
-		handler, err := loadMqttPlugin(p.Name, p.Path)
-		if err != nil {
-			log.Fatalf("failed to load handler: Name: [%s] Path: [%s] Error: [%s]", p.Name, p.Path, err)
-		}
-		MqttPluginHandlers[t] = handler
-		log.Infof("Plugin: [%s] for Topic: [%s]  => [%s]", p.Name, t, p.Path)
+	// node to TAK identity mapping
+	identities, err := tak.NewIdentityRegistry(cfg.TAKIdentity)
+	if err != nil {
+		log.Fatalf("failed to load TAK identities: %s", err)
 	}
 
 	// setup telegraf publisher
@@ -162,74 +160,149 @@ func main() {
 	}()
 	wg.Add(1)
 
-	// start telegraf publisher
+	// start telegraf publisher, it outlives ctx so queued messages can drain on shutdown
 	log.Info("starting telegraf publisher")
-	go startPublisher(ctx, &wg, cfg.TelegrafURL, telegrafChannel)
-
-	// setup MQTT connection
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(cfg.Broker)
-	opts.SetClientID(cfg.ClientID)
-	opts.SetUsername(cfg.Username)
-	opts.SetPassword(cfg.Password)
+	publisherCtx, stopPublisher := context.WithCancel(context.Background())
+	transformer, err := transform.New(cfg.Transform)
+	if err != nil {
+		log.Fatalf("failed to load transform script: %s", err)
+	}
+	go transformer.Watch(ctx)
+	go startPublisher(publisherCtx, &wg, cfg.TelegrafURL, telegrafChannel, transformer)
 
 	takCerts := shared.TAKCerts{
 		TLSClientConfig: tlsConfig,
 	}
 
-	opts.SetDefaultPublishHandler(makeHandler(&shared.MqttMessageHandlerContext{
-		Plugs:                   MqttPluginHandlers,
+	takPoster, err := tak.NewPoster(cfg.TAKServer, tlsConfig, cfg.TAKHTTP)
+	if err != nil {
+		log.Fatalf("failed to setup TAK poster: %s", err)
+	}
+
+	rtl433Decoder, err := rtl433.NewDecoder(cfg.RTL433)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handlerCtx := shared.MqttMessageHandlerContext{
 		TelegrafChan:            telegrafChannel,
 		ChannelKeys:             channelKeys,
 		ChannelKeysByChannelNum: channelKeysByChannelNum,
 		TAKServer:               cfg.TAKServer,
 		TAKCerts:                takCerts,
-	}))
-
-	client := mqtt.NewClient(opts)
-
-	// connect to MQTT broker
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal("Error connecting to MQTT broker:", token.Error())
-		os.Exit(1)
+		TAK:                     takPoster,
+		Identities:              identities,
+		PositionFilter:          position.NewFilter(cfg.PositionFilter),
+		RTL433:                  rtl433Decoder,
+		RTL433Devices:           rtl433.NewRegistry(cfg.RTL433.Registry),
+		Mappings:                cfg.Mappings,
+		Transform:               transformer,
 	}
 
-	log.Info("connected to MQTT broker")
+	// Load Plugins, the table of local inputs covers the topics of every broker
+	services, err := shared.NewPluginServices(&handlerCtx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plugins := newPluginCache(services, cfg.PluginBreaker)
+	localPlugins, err := plugins.handlers(utils.LocalTopics(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
+	handlerCtx.Plugs = localPlugins
 
 	// check topics exist
-	if len(cfg.Topics) == 0 {
+	if len(localPlugins) == 0 {
 		log.Fatal("Error no topics listed in json file, aborting")
 		os.Exit(1)
 	}
 
-	for topic, v := range cfg.Topics {
-		log.Infof("subscribed to topic: ['%s'] with Qos: [%d]", topic, v.QoS)
+	// plugins run on the dispatch workers, not on the MQTT callbacks
+	dispatch, err := newDispatcher(cfg.Dispatch)
+	if err != nil {
+		log.Fatal(err)
 	}
+	go dispatch.report(ctx, telegrafChannel)
 
-	// subscripe to MQTT Topic and process in messageHandler()
-	if token := client.SubscribeMultiple(utils.TopicsQoSFromConfig(cfg.Topics), nil); token.Wait() && token.Error() != nil {
-		log.Fatal("Subscription error:", token.Error())
-		os.Exit(1)
+	// start radios and listeners feeding the same plugins as the brokers
+	startInputs(ctx, cfg.Inputs, dispatch.wrap(makeHandler(&handlerCtx)), identities)
+
+	// every broker dispatches to its own topic table and shares the rest of the pipeline
+	clients := make(map[string]brokerClient)
+	for _, b := range cfg.Brokers {
+		brokerCtx := handlerCtx
+		brokerCtx.Plugs, err = plugins.handlers(b.Topics)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// setup MQTT connection, it reconnects and resubscribes on its own
+		client, err := connectBroker(ctx, b, dispatch.wrap(makeHandler(&brokerCtx)), telegrafChannel)
+		if err != nil {
+			log.Fatalf("Error connecting to MQTT broker [%s]: %s", b.Name, err)
+		}
+		clients[b.Name] = client
+	}
+	if len(clients) == 0 && !cfg.EmbeddedBroker.Enabled {
+		log.Warn("no MQTT broker configured, processing local inputs only")
 	}
 
-	// idle and wait for shutdowns
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info("Metric generator shutting down.")
-				return
-			default:
-				time.Sleep(250 * time.Millisecond)
+	// radios can uplink straight to the embedded broker
+	var embedded *mochi.Server
+	if cfg.EmbeddedBroker.Enabled {
+		embeddedCtx := handlerCtx
+		if len(cfg.EmbeddedBroker.Topics) > 0 {
+			embeddedCtx.Plugs, err = plugins.handlers(cfg.EmbeddedBroker.Topics)
+			if err != nil {
+				log.Fatal(err)
 			}
 		}
-	}()
 
+		embedded, err = startEmbeddedBroker(ctx, cfg.EmbeddedBroker, dispatch.wrap(makeHandler(&embeddedCtx)), clients)
+		if err != nil {
+			log.Fatalf("failed to start embedded MQTT broker: %s", err)
+		}
+	}
+
+	plugins.reportHealth(ctx, telegrafChannel)
+
+	// bridge TAK positions back into the mesh
+	if cfg.TAKBridge.Enabled {
+		brokerName := cfg.TAKBridge.Broker
+		if brokerName == "" && len(cfg.Brokers) > 0 {
+			brokerName = cfg.Brokers[0].Name
+		}
+		client, ok := clients[brokerName]
+		if !ok {
+			log.Fatalf("TAK bridge needs an MQTT broker to publish into the mesh, [%s] is not configured", brokerName)
+		}
+		bridge, err := newTAKBridge(cfg.TAKBridge, client, identities)
+		if err != nil {
+			log.Fatalf("failed to setup TAK bridge: %s", err)
+		}
+		go bridge.run(ctx, tlsConfig)
+	}
+
+	// idle and wait for shutdowns
+	<-ctx.Done()
+
+	// stop the message sources first, then drain what is queued
+	if embedded != nil {
+		log.Info("Stopping embedded MQTT broker")
+		if err := embedded.Close(); err != nil {
+			log.Warnf("embedded MQTT broker close: %s", err)
+		}
+	}
+	for name, client := range clients {
+		log.Infof("Disconnecting from MQTT broker [%s]", name)
+		client.Disconnect()
+	}
+	dispatch.close()
+	plugins.close()
+
+	stopPublisher()
 	wg.Wait()
 	log.Info("All routines complete. Exiting.")
-	// shutdown MQTT server
-	log.Info("Disconnecting from MQTT broker")
-	client.Disconnect(250)
 
 	// terminate
 	time.Sleep(time.Second)
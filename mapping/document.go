@@ -0,0 +1,153 @@
+package mapping
+
+import (
+	"bytes"
+	"encoding/json"
+	"gomqttenc/metrics"
+	"gomqttenc/shared"
+	"math"
+	"strconv"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var protoJSON = protojson.MarshalOptions{UseProtoNames: true}
+
+// FromJSON decodes a JSON payload for Map, numbers are kept as json.Number
+func FromJSON(payload []byte) (interface{}, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// FromProto decodes a protobuf message for Map through its JSON form: proto field names,
+// enums by name, bytes in base64 and 64 bit integers as strings
+func FromProto(msg proto.Message) (interface{}, error) {
+	payload, err := protoJSON.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return FromJSON(payload)
+}
+
+// MapDecoded maps a payload decoded by shared.ProcessMessage. Payloads that are not
+// protobuf messages, such as text messages, are not mapped.
+func (m *Mapper) MapDecoded(in Input, decoded interface{}) []metrics.Point {
+	msg, ok := decoded.(proto.Message)
+	if m == nil || !ok {
+		return nil
+	}
+
+	doc, err := FromProto(msg)
+	if err != nil {
+		log.Warnf("mapping: failed to convert [%s] payload: %s", in.Portnum, err)
+		return nil
+	}
+	in.Doc = doc
+	return m.Map(in)
+}
+
+func lookup(doc interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			doc = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, doc != nil
+}
+
+// convert scales and types a scalar value, objects and arrays are not exported
+func convert(value interface{}, f shared.MappingField) (interface{}, bool) {
+	scaled := f.Scale != 1 || f.Offset != 0
+
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil && !scaled {
+			return typed(float64(i), i, true, f.Type), true
+		}
+		n, err := v.Float64()
+		if err != nil {
+			return nil, false
+		}
+		return number(n, f), true
+
+	case string:
+		if f.Type == TypeBool {
+			b, err := strconv.ParseBool(v)
+			return b, err == nil
+		}
+		if (f.Type == "" || f.Type == TypeString) && !scaled {
+			return v, true
+		}
+		// 64 bit integers are strings in the JSON form of protobuf messages
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil && !scaled {
+			return typed(float64(i), i, true, f.Type), true
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, false
+		}
+		return number(n, f), true
+
+	case bool:
+		switch f.Type {
+		case "", TypeBool:
+			return v, true
+		case TypeString:
+			return strconv.FormatBool(v), true
+		}
+		n := 0.0
+		if v {
+			n = 1
+		}
+		return number(n, f), true
+
+	default:
+		return nil, false
+	}
+}
+
+func number(n float64, f shared.MappingField) interface{} {
+	n = n*f.Scale + f.Offset
+	return typed(n, int64(math.Round(n)), false, f.Type)
+}
+
+// typed returns n as Type t, integers stay integers without a type
+func typed(n float64, i int64, isInt bool, t string) interface{} {
+	switch t {
+	case TypeInt:
+		return i
+	case TypeString:
+		if isInt {
+			return strconv.FormatInt(i, 10)
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case TypeBool:
+		return n != 0
+	case TypeFloat:
+		return n
+	}
+	if isInt {
+		return i
+	}
+	return n
+}
@@ -0,0 +1,213 @@
+// Package mapping exports decoded messages as metric points following configured rules,
+// so new measurements and firmware fields need a config change instead of a release.
+// Protobuf payloads are mapped through their JSON form with the proto field names
+//
+//	{"portnum": "TELEMETRY_APP", "measurement": "power",
+//	 "tags": [{"path": "variant"}],
+//	 "fields": [{"path": "power_metrics.ch1_voltage", "name": "voltage"},
+//	            {"path": "power_metrics.ch1_current", "name": "current", "scale": 0.001}]}
+//
+// A path is a dot separated list of object keys and array indexes. A rule produces a point
+// only when at least one of its fields is present in the message.
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/shared"
+	"gomqttenc/utils"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/rabarar/meshtastic"
+)
+
+const (
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeString = "string"
+	TypeBool   = "bool"
+)
+
+var ErrInvalidRule = errors.New("invalid mapping rule")
+
+// Input is a decoded message offered to the rules. Tags are added to every point, the
+// tags of a rule take precedence.
+type Input struct {
+	Portnum string
+	Topic   string
+	Doc     interface{}
+	Tags    map[string]string
+	Time    time.Time
+}
+
+type field struct {
+	shared.MappingField
+	path []string
+}
+
+type rule struct {
+	shared.MappingRule
+	tags   []field
+	fields []field
+	time   []string
+}
+
+// Mapper holds the validated rules
+type Mapper struct {
+	rules []rule
+}
+
+// New validates rules. Without rules it returns nil, a nil Mapper maps nothing.
+func New(rules []shared.MappingRule) (*Mapper, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	m := &Mapper{}
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if r.Measurement == "" {
+			return nil, fmt.Errorf("%w [%s]: no measurement", ErrInvalidRule, name)
+		}
+		if r.Portnum == "" && r.Topic == "" {
+			return nil, fmt.Errorf("%w [%s]: no portnum or topic to match", ErrInvalidRule, name)
+		}
+		if _, ok := meshtastic.PortNum_value[r.Portnum]; r.Portnum != "" && !ok {
+			return nil, fmt.Errorf("%w [%s]: unknown portnum [%s]", ErrInvalidRule, name, r.Portnum)
+		}
+		if len(r.Fields) == 0 {
+			return nil, fmt.Errorf("%w [%s]: no fields", ErrInvalidRule, name)
+		}
+
+		compiled := rule{MappingRule: r, time: splitPath(r.Time)}
+		compiled.Name = name
+		var err error
+		if compiled.tags, err = compileFields(name, r.Tags); err != nil {
+			return nil, err
+		}
+		if compiled.fields, err = compileFields(name, r.Fields); err != nil {
+			return nil, err
+		}
+		m.rules = append(m.rules, compiled)
+	}
+
+	log.Debugf("mapping: %d rules loaded", len(m.rules))
+	return m, nil
+}
+
+func compileFields(rule string, fields []shared.MappingField) ([]field, error) {
+	compiled := make([]field, 0, len(fields))
+	for _, f := range fields {
+		path := splitPath(f.Path)
+		if len(path) == 0 {
+			return nil, fmt.Errorf("%w [%s]: field without path", ErrInvalidRule, rule)
+		}
+		switch f.Type {
+		case "", TypeInt, TypeFloat, TypeString, TypeBool:
+		default:
+			return nil, fmt.Errorf("%w [%s]: unknown type [%s] of [%s]", ErrInvalidRule, rule, f.Type, f.Path)
+		}
+		if f.Name == "" {
+			f.Name = path[len(path)-1]
+		}
+		if f.Scale == 0 {
+			f.Scale = 1
+		}
+		compiled = append(compiled, field{MappingField: f, path: path})
+	}
+	return compiled, nil
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// Map returns a point for every rule matching in
+func (m *Mapper) Map(in Input) []metrics.Point {
+	if m == nil {
+		return nil
+	}
+
+	var points []metrics.Point
+	for _, r := range m.rules {
+		if r.Portnum != "" && r.Portnum != in.Portnum {
+			continue
+		}
+		if r.Topic != "" && !utils.TopicMatches(r.Topic, in.Topic) {
+			continue
+		}
+
+		point, ok := r.apply(in)
+		if !ok {
+			log.Debugf("mapping [%s]: no field of [%s] present", r.Name, in.Topic)
+			continue
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+func (r rule) apply(in Input) (metrics.Point, bool) {
+	point := metrics.Point{
+		Measurement: r.Measurement,
+		Tags:        make(map[string]string, len(in.Tags)+len(r.tags)+1),
+		Fields:      make(map[string]interface{}, len(r.fields)),
+		Time:        in.Time,
+	}
+
+	for _, f := range r.fields {
+		value, ok := lookup(in.Doc, f.path)
+		if !ok {
+			continue
+		}
+		if v, ok := convert(value, f.MappingField); ok {
+			point.Fields[f.Name] = v
+		} else {
+			log.Debugf("mapping [%s]: [%s] is not a %s value", r.Name, f.Path, typeName(f.Type))
+		}
+	}
+	if len(point.Fields) == 0 {
+		return point, false
+	}
+
+	if in.Portnum != "" {
+		point.Tags["portnum"] = in.Portnum
+	}
+	for k, v := range in.Tags {
+		point.Tags[k] = v
+	}
+	for _, f := range r.tags {
+		value, ok := lookup(in.Doc, f.path)
+		if !ok {
+			continue
+		}
+		if v, ok := convert(value, f.MappingField); ok {
+			point.Tags[f.Name] = fmt.Sprint(v)
+		}
+	}
+
+	if r.time != nil {
+		if value, ok := lookup(in.Doc, r.time); ok {
+			if secs, ok := convert(value, shared.MappingField{Scale: 1, Type: TypeFloat}); ok && secs.(float64) > 0 {
+				point.Time = time.Unix(0, int64(secs.(float64)*float64(time.Second)))
+			}
+		}
+	}
+	return point, true
+}
+
+func typeName(t string) string {
+	if t == "" {
+		return "scalar"
+	}
+	return t
+}
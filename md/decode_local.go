@@ -2,6 +2,7 @@ package md
 
 import (
 	"errors"
+	"fmt"
 	"gomqttenc/shared"
 	"gomqttenc/utils"
 
@@ -13,6 +14,7 @@ import (
 var (
 	ErrUnkownPayloadType = errors.New("unknown payload type")
 	ErrDecrypt           = errors.New("unable to decrypt payload")
+	ErrMissingKey        = errors.New("missing decryption key")
 )
 
 type DecryptType int
@@ -38,21 +40,29 @@ func TryDecode(packet *meshtastic.MeshPacket, keys []shared.Key, decryptType Dec
 
 		switch decryptType {
 		case DecryptChannel:
+			if len(keys) == 0 {
+				return nil, ErrMissingKey
+			}
 			decrypted, err = XOR(packet.GetEncrypted(), keys[0].Hex, packet.Id, packet.From)
 			if err != nil {
 				log.Warnf("Failed decrypting packet: %s", err)
 				return nil, ErrDecrypt
 			}
 		case DecryptDirect:
+			if len(keys) <= int(SenderKeyIndex) {
+				return nil, ErrMissingKey
+			}
 			// Sender's private key
 			// derive sender's public key
 			keyslice, err := utils.SliceTo32ByteArray(keys[SenderKeyIndex].Hex)
 			if err != nil {
-				log.Fatal(err)
+				log.Warnf("Bad sender key: %s", err)
+				return nil, fmt.Errorf("%w: sender key: %w", ErrDecrypt, err)
 			}
 			senderPub, err := PublicKeyFromPrivateKey(*keyslice)
 			if err != nil {
-				log.Fatal(err)
+				log.Warnf("Failed deriving sender public key: %s", err)
+				return nil, fmt.Errorf("%w: sender key: %w", ErrDecrypt, err)
 			}
 
 			decrypted, err = DecryptCurve25519(packet.From, packet.Id, senderPub[:], keys[ReceiverKeyIndex].Hex, packet.GetEncrypted())
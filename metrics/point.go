@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is a generic Influx line protocol record for the Telegraf channel, used by sources
+// whose fields are not known at compile time
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// Line encodes the point in line protocol. A zero Time is replaced by now. Points without
+// any fields are invalid in line protocol and return an error.
+func (p Point) Line(now time.Time) (string, error) {
+	if len(p.Fields) == 0 {
+		return "", fmt.Errorf("point [%s] has no fields", p.Measurement)
+	}
+
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.Measurement))
+
+	for _, k := range sortedKeys(p.Tags) {
+		if p.Tags[k] == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(keyEscaper.Replace(p.Tags[k]))
+	}
+
+	b.WriteByte(' ')
+	for i, k := range sortedKeys(p.Fields) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(formatField(p.Fields[k]))
+	}
+
+	ts := p.Time
+	if ts.IsZero() {
+		ts = now
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+
+	return b.String(), nil
+}
+
+// AppendTags adds tags to the tag set of a line protocol record, the tag set ending at the
+// first unescaped space
+func AppendTags(line string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return line
+	}
+
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == ' ' {
+			end = i
+			break
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(line[:end])
+	for _, k := range sortedKeys(tags) {
+		if tags[k] == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(keyEscaper.Replace(tags[k]))
+	}
+	b.WriteString(line[end:])
+	return b.String()
+}
+
+func formatField(v interface{}) string {
+	switch f := v.(type) {
+	case float64:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(f), 'f', -1, 32)
+	case int:
+		return strconv.Itoa(f) + "i"
+	case int32:
+		return strconv.FormatInt(int64(f), 10) + "i"
+	case int64:
+		return strconv.FormatInt(f, 10) + "i"
+	case uint32:
+		return strconv.FormatUint(uint64(f), 10) + "i"
+	case uint64:
+		return strconv.FormatUint(f, 10) + "i"
+	case bool:
+		return strconv.FormatBool(f)
+	case string:
+		return `"` + stringEscaper.Replace(f) + `"`
+	default:
+		return `"` + stringEscaper.Replace(fmt.Sprint(f)) + `"`
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,30 +1,67 @@
 package main
 
 import (
+	"errors"
 	"gomqttenc/shared"
 	"gomqttenc/utils"
+	"reflect"
 
 	"github.com/charmbracelet/log"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// makeHandler dispatches a message to the plugins of every topic filter it matches, the
+// most specific filter first and the plugins of a filter in their listed order. A plugin
+// matched by several filters runs once.
 func makeHandler(ctx *shared.MqttMessageHandlerContext) mqtt.MessageHandler {
+	router := utils.NewTopicTrie[shared.MqttPluginHandler]()
+	for filter, handlers := range ctx.Plugs {
+		for _, handler := range handlers {
+			router.Add(filter, handler)
+		}
+	}
+
 	return func(client mqtt.Client, msg mqtt.Message) {
 
 		topic := msg.Topic()
 		log.Infof("Received MQTT message from topic: \x1b[33m%s\x1b[0m", topic)
 
-		for handlerName, handler := range ctx.Plugs {
-			if utils.TopicMatches(handlerName, topic) {
-				log.Infof("Topic Matches [%s] [%s]", handlerName, topic)
-				err := handler.Process(topic, ctx, msg)
-				if err != nil {
-					log.Errorf("failed to process [%s] with handler [%s] error: [%s]", topic, handlerName, err)
-				} else {
-					log.Infof("Dispatched [%s] =>  [%s]", topic, handlerName)
-				}
-				return
+		var dispatched []shared.MqttPluginHandler
+		for _, match := range router.Match(topic) {
+			if containsHandler(dispatched, match.Value) {
+				log.Debugf("Topic [%s] already dispatched to the plugin of [%s]", topic, match.Filter)
+				continue
 			}
+			dispatched = append(dispatched, match.Value)
+
+			log.Infof("Topic Matches [%s] [%s]", match.Filter, topic)
+			err := match.Value.Process(topic, ctx, msg)
+			if errors.Is(err, shared.ErrPluginDisabled) {
+				log.Debugf("skipped [%s]: %s", topic, err)
+			} else if err != nil {
+				log.Errorf("failed to process [%s] with handler [%s] error: [%s]", topic, match.Filter, err)
+			} else {
+				log.Infof("Dispatched [%s] =>  [%s]", topic, match.Filter)
+			}
+		}
+
+		if len(dispatched) == 0 {
+			log.Debugf("no plugin for topic [%s]", topic)
+		}
+	}
+}
+
+// containsHandler reports whether handler is in handlers. Plugins of different files have
+// different types, so only handlers of the same comparable type can be equal.
+func containsHandler(handlers []shared.MqttPluginHandler, handler shared.MqttPluginHandler) bool {
+	t := reflect.TypeOf(handler)
+	if !t.Comparable() {
+		return false
+	}
+	for _, h := range handlers {
+		if reflect.TypeOf(h) == t && h == handler {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"gomqttenc/shared"
+	"reflect"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type recordingHandler struct {
+	name  string
+	calls *[]string
+}
+
+func (h *recordingHandler) Process(topic string, _ interface{}, _ mqtt.Message) error {
+	*h.calls = append(*h.calls, h.name+" "+topic)
+	return nil
+}
+
+func TestMakeHandlerFanOut(t *testing.T) {
+	var calls []string
+	a := &recordingHandler{name: "a", calls: &calls}
+	b := &recordingHandler{name: "b", calls: &calls}
+	c := &recordingHandler{name: "c", calls: &calls}
+
+	handler := makeHandler(&shared.MqttMessageHandlerContext{Plugs: shared.MqttPluginHandlers{
+		"weather/+/state": {a, b},
+		"weather/#":       {b, c},
+		"msh/#":           {a},
+	}})
+
+	handler(nil, &shared.LocalMessage{TopicName: "weather/roof/state"})
+	handler(nil, &shared.LocalMessage{TopicName: "msh/US/2/e/LongFast/!a1"})
+
+	// the plugins of the most specific filter first, b matched by both filters runs once
+	want := []string{
+		"a weather/roof/state",
+		"b weather/roof/state",
+		"c weather/roof/state",
+		"a msh/US/2/e/LongFast/!a1",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls\n  %q\nwant\n  %q", calls, want)
+	}
+}
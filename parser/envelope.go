@@ -1,8 +1,59 @@
 package parser
 
+import "strconv"
+
+// MessageEnvelope describes where a message came from. Properties holds the MQTT v5 user
+// properties of the publish, nil for MQTT 3.1.1 and local inputs. Tags are extra tags for
+// the published line, set by the transform stage. Gateway is the node that uplinked the
+// packet, RSSI and SNR its reception of it, all zero when the uplink does not carry them.
+// Region, SubRegion, Channel and Format are parsed from a Meshtastic topic. ChannelIndex is
+// the index of the channel on the gateway, only known for JSON uplinks.
 type MessageEnvelope struct {
-	To     uint32
-	From   uint32
-	Device uint32
-	Topic  string
+	To           uint32
+	From         uint32
+	Device       uint32
+	Topic        string
+	Properties   map[string]string
+	Tags         map[string]string
+	Gateway      string
+	RSSI         int
+	SNR          float64
+	HopsAway     int
+	Region       string
+	SubRegion    string
+	Channel      string
+	Format       string
+	ChannelIndex *int
+}
+
+// SetMeshTopic fills the envelope with the parts of t, keeping a gateway already known
+func (e *MessageEnvelope) SetMeshTopic(t MeshTopic) {
+	e.Region = t.Region
+	e.SubRegion = t.SubRegion
+	e.Channel = t.Channel
+	e.Format = t.Format
+	if e.Gateway == "" {
+		e.Gateway = t.Gateway
+	}
+}
+
+// TopicTags returns the topic parts, gateway and channel index of the envelope as metric
+// tags, empty ones left out
+func (e MessageEnvelope) TopicTags() map[string]string {
+	tags := make(map[string]string, 5)
+	for k, v := range map[string]string{
+		"region":    e.Region,
+		"subregion": e.SubRegion,
+		"channel":   e.Channel,
+		"format":    e.Format,
+		"gateway":   e.Gateway,
+	} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	if e.ChannelIndex != nil {
+		tags["channel_index"] = strconv.Itoa(*e.ChannelIndex)
+	}
+	return tags
 }
@@ -0,0 +1,234 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rabarar/meshtastic"
+)
+
+var ErrUnsupportedJSONType = errors.New("JSON payload type without event")
+
+// payload types of the firmware JSON output and the portnum they are decoded from
+var jsonPortnums = map[string]meshtastic.PortNum{
+	"text":         meshtastic.PortNum_TEXT_MESSAGE_APP,
+	"nodeinfo":     meshtastic.PortNum_NODEINFO_APP,
+	"position":     meshtastic.PortNum_POSITION_APP,
+	"telemetry":    meshtastic.PortNum_TELEMETRY_APP,
+	"mapreport":    meshtastic.PortNum_MAP_REPORT_APP,
+	"neighborinfo": meshtastic.PortNum_NEIGHBORINFO_APP,
+	"traceroute":   meshtastic.PortNum_TRACEROUTE_APP,
+	"detection":    meshtastic.PortNum_DETECTION_SENSOR_APP,
+	"remotehw":     meshtastic.PortNum_REMOTE_HARDWARE_APP,
+	"waypoint":     meshtastic.PortNum_WAYPOINT_APP,
+	"paxcounter":   meshtastic.PortNum_PAXCOUNTER_APP,
+}
+
+// JSONMessage is a packet uplinked by a node with JSON output enabled, published on
+// msh/<region>/2/json/<channel>/<gateway>. Sender is the gateway node, RSSI and SNR are
+// measured by it.
+type JSONMessage struct {
+	Id        uint32          `json:"id"`
+	Timestamp int64           `json:"timestamp"`
+	From      uint32          `json:"from"`
+	To        uint32          `json:"to"`
+	Channel   int             `json:"channel"`
+	Type      string          `json:"type"`
+	Sender    string          `json:"sender"`
+	RSSI      int             `json:"rssi"`
+	SNR       float64         `json:"snr"`
+	HopStart  int             `json:"hop_start"`
+	HopsAway  int             `json:"hops_away"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type jsonNodeInfo struct {
+	Id        string `json:"id"`
+	LongName  string `json:"longname"`
+	ShortName string `json:"shortname"`
+	Hardware  int32  `json:"hardware"`
+}
+
+type jsonMapReport struct {
+	LongName            string `json:"long_name"`
+	ShortName           string `json:"short_name"`
+	HwModel             int32  `json:"hw_model"`
+	FirmwareVersion     string `json:"firmware_version"`
+	Region              int32  `json:"region"`
+	HasDefaultChannel   bool   `json:"has_default_channel"`
+	LatitudeI           int    `json:"latitude_i"`
+	LongitudeI          int    `json:"longitude_i"`
+	Altitude            int    `json:"altitude"`
+	PositionPrecision   int    `json:"position_precision"`
+	NumOnlineLocalNodes int    `json:"num_online_local_nodes"`
+}
+
+type jsonPosition struct {
+	LatitudeI     *int   `json:"latitude_i"`
+	LongitudeI    *int   `json:"longitude_i"`
+	Altitude      int    `json:"altitude"`
+	Time          int64  `json:"time"`
+	Timestamp     *int64 `json:"timestamp"`
+	SeqNumber     *int   `json:"seq_number"`
+	SatsInView    *int   `json:"sats_in_view"`
+	GroundSpeed   int    `json:"ground_speed"`
+	GroundTrack   int    `json:"ground_track"`
+	PrecisionBits int    `json:"precision_bits"`
+}
+
+type jsonTelemetry struct {
+	BatteryLevel       *int     `json:"battery_level"`
+	Voltage            float64  `json:"voltage"`
+	ChannelUtilization *float64 `json:"channel_utilization"`
+	AirUtilTx          float64  `json:"air_util_tx"`
+	UptimeSeconds      *int     `json:"uptime_seconds"`
+	Temperature        *float64 `json:"temperature"`
+	RelativeHumidity   *float64 `json:"relative_humidity"`
+}
+
+type jsonText struct {
+	Text string `json:"text"`
+}
+
+// ParseJSONMessage decodes a JSON uplink, the payload is decoded by Event
+func ParseJSONMessage(payload []byte) (*JSONMessage, error) {
+	var m JSONMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON uplink: %w", err)
+	}
+	if m.Type == "" {
+		return nil, fmt.Errorf("JSON uplink of [%x] without type", m.From)
+	}
+	return &m, nil
+}
+
+// Portnum returns the portnum of the payload type, UNKNOWN_APP for types it does not know
+func (m *JSONMessage) Portnum() meshtastic.PortNum {
+	return jsonPortnums[m.Type]
+}
+
+// Envelope returns the envelope of the packet received on topic
+func (m *JSONMessage) Envelope(topic string, properties map[string]string) MessageEnvelope {
+	return MessageEnvelope{
+		To:           m.To,
+		From:         m.From,
+		Device:       m.From,
+		Topic:        topic,
+		Properties:   properties,
+		Gateway:      m.Sender,
+		RSSI:         m.RSSI,
+		SNR:          m.SNR,
+		HopsAway:     m.HopsAway,
+		ChannelIndex: &m.Channel,
+	}
+}
+
+// Event decodes the payload into the message the protobuf path produces for its portnum:
+// NodeInfoMessage, MapReportMessage, PositionMessage, DeviceMetrics, EnvironmentMetrics or
+// a *TextMessage, with env as envelope. Other types return ErrUnsupportedJSONType.
+func (m *JSONMessage) Event(env MessageEnvelope) (interface{}, error) {
+	switch m.Portnum() {
+	case meshtastic.PortNum_NODEINFO_APP:
+		var p jsonNodeInfo
+		if err := m.decodePayload(&p); err != nil {
+			return nil, err
+		}
+		return NodeInfoMessage{
+			Envelope:  env,
+			Id:        p.Id,
+			LongName:  p.LongName,
+			ShortName: p.ShortName,
+			HWModel:   meshtastic.HardwareModel(p.Hardware).String(),
+		}, nil
+
+	case meshtastic.PortNum_MAP_REPORT_APP:
+		var p jsonMapReport
+		if err := m.decodePayload(&p); err != nil {
+			return nil, err
+		}
+		return MapReportMessage{
+			Envelope:            env,
+			LongName:            p.LongName,
+			ShortName:           p.ShortName,
+			HwModel:             meshtastic.HardwareModel(p.HwModel).String(),
+			FirmwareVersion:     p.FirmwareVersion,
+			Region:              meshtastic.Config_LoRaConfig_RegionCode(p.Region).String(),
+			HasDefaultChannel:   p.HasDefaultChannel,
+			LatitudeI:           p.LatitudeI,
+			LongitudeI:          p.LongitudeI,
+			Altitude:            p.Altitude,
+			PositionPrecision:   p.PositionPrecision,
+			NumOnlineLocalNodes: p.NumOnlineLocalNodes,
+		}, nil
+
+	case meshtastic.PortNum_POSITION_APP:
+		var p jsonPosition
+		if err := m.decodePayload(&p); err != nil {
+			return nil, err
+		}
+		if p.LatitudeI == nil || p.LongitudeI == nil {
+			return nil, fmt.Errorf("JSON position of [%x] without coordinates", m.From)
+		}
+		return PositionMessage{
+			Envelope:      env,
+			LatitudeI:     *p.LatitudeI,
+			LongitudeI:    *p.LongitudeI,
+			Altitude:      p.Altitude,
+			Time:          p.Time,
+			Timestamp:     p.Timestamp,
+			SeqNumber:     p.SeqNumber,
+			SatsInView:    p.SatsInView,
+			GroundSpeed:   p.GroundSpeed,
+			GroundTrack:   p.GroundTrack,
+			PrecisionBits: p.PrecisionBits,
+		}, nil
+
+	case meshtastic.PortNum_TELEMETRY_APP:
+		var p jsonTelemetry
+		if err := m.decodePayload(&p); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.BatteryLevel != nil || p.ChannelUtilization != nil || p.UptimeSeconds != nil:
+			return DeviceMetrics{
+				Envelope:           env,
+				BatteryLevel:       valueOf(p.BatteryLevel),
+				Voltage:            p.Voltage,
+				ChannelUtilization: valueOf(p.ChannelUtilization),
+				AirUtilTx:          p.AirUtilTx,
+				UptimeSeconds:      valueOf(p.UptimeSeconds),
+			}, nil
+		case p.Temperature != nil || p.RelativeHumidity != nil:
+			return EnvironmentMetrics{
+				Envelope:         env,
+				Temperature:      valueOf(p.Temperature),
+				RelativeHumidity: valueOf(p.RelativeHumidity),
+			}, nil
+		}
+
+	case meshtastic.PortNum_TEXT_MESSAGE_APP:
+		var p jsonText
+		if err := m.decodePayload(&p); err != nil {
+			return nil, err
+		}
+		return ParseTextMessage(p.Text)
+	}
+
+	return nil, fmt.Errorf("%w: [%s]", ErrUnsupportedJSONType, m.Type)
+}
+
+func (m *JSONMessage) decodePayload(v interface{}) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("failed to parse JSON %s payload of [%x]: %w", m.Type, m.From, err)
+	}
+	return nil
+}
+
+func valueOf[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	TopicVersion = "2"
+	DefaultRoot  = "msh"
+
+	FormatEncrypted = "e"
+	FormatCrypt     = "c"
+	FormatJSON      = "json"
+	FormatMap       = "map"
+	FormatStat      = "stat"
+)
+
+var ErrNotMeshTopic = errors.New("not a Meshtastic topic")
+
+var topicFormats = map[string]bool{
+	FormatEncrypted: true,
+	FormatCrypt:     true,
+	FormatJSON:      true,
+	FormatMap:       true,
+	FormatStat:      true,
+}
+
+// MeshTopic is a topic of the Meshtastic MQTT grammar
+//
+//	<root>/<region>[/<subregion>...]/2/<e|c|json>/<channel>/<!gateway>
+//	<root>/<region>[/<subregion>...]/2/map/
+//	<root>/<region>[/<subregion>...]/2/stat/<!gateway>
+//
+// The root ends with the first msh level, custom roots without one are a single level.
+// SubRegion joins the levels between the region and the version with /.
+type MeshTopic struct {
+	Root      string
+	Region    string
+	SubRegion string
+	Format    string
+	Channel   string
+	Gateway   string
+}
+
+// ParseMeshTopic splits topic into its parts, anchored on the 2/<format> levels
+func ParseMeshTopic(topic string) (MeshTopic, error) {
+	levels := strings.Split(topic, "/")
+
+	version := -1
+	for i := 0; i+1 < len(levels); i++ {
+		if levels[i] == TopicVersion && topicFormats[levels[i+1]] {
+			version = i
+			break
+		}
+	}
+	if version < 2 {
+		return MeshTopic{}, fmt.Errorf("%w: [%s]", ErrNotMeshTopic, topic)
+	}
+
+	prefix := levels[:version]
+	root := 1
+	for i, level := range prefix[:len(prefix)-1] {
+		if level == DefaultRoot {
+			root = i + 1
+			break
+		}
+	}
+
+	t := MeshTopic{
+		Root:      strings.Join(prefix[:root], "/"),
+		Region:    prefix[root],
+		SubRegion: strings.Join(prefix[root+1:], "/"),
+		Format:    levels[version+1],
+	}
+
+	rest := levels[version+2:]
+	switch t.Format {
+	case FormatMap:
+	case FormatStat:
+		if len(rest) > 0 {
+			t.Gateway = rest[0]
+		}
+	default:
+		if len(rest) > 0 {
+			t.Channel = rest[0]
+		}
+		if len(rest) > 1 {
+			t.Gateway = rest[1]
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/shared"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+
+	defaultBreakerWindow          = 60
+	defaultBreakerMinCalls        = 20
+	defaultBreakerMaxFailureRatio = 1.0
+	defaultBreakerMaxPanics       = 5
+	defaultBreakerCooldown        = 60
+	pluginHealthMeasurement       = "gomqttenc_plugin_health"
+	pluginHealthReportInterval    = time.Minute
+)
+
+// guardedHandler isolates a plugin: panics are recovered and returned as errors, and a
+// circuit breaker stops calling a plugin that keeps failing
+type guardedHandler struct {
+	name    string
+	handler shared.MqttPluginHandler
+	breaker *breaker
+	health  chan<- pluginHealth
+}
+
+func newGuardedHandler(name string, handler shared.MqttPluginHandler, cfg shared.PluginBreakerConfig, health chan<- pluginHealth) *guardedHandler {
+	return &guardedHandler{
+		name:    name,
+		handler: handler,
+		breaker: newBreaker(cfg),
+		health:  health,
+	}
+}
+
+func (g *guardedHandler) Process(topic string, ctx interface{}, msg mqtt.Message) (err error) {
+	now := time.Now()
+	if !g.breaker.allow(now) {
+		return &shared.PluginError{Plugin: g.name, Topic: topic, Err: shared.ErrPluginDisabled}
+	}
+
+	panicked := false
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			log.Errorf("plugin [%s] panicked on [%s]: %v\n%s", g.name, topic, r, debug.Stack())
+			err = &shared.PluginError{Plugin: g.name, Topic: topic, Err: fmt.Errorf("%w: %v", shared.ErrPluginPanic, r)}
+		}
+		if changed, state := g.breaker.record(time.Now(), err, panicked); changed {
+			g.stateChanged(state)
+		}
+	}()
+
+	if err := g.handler.Process(topic, ctx, msg); err != nil {
+		return &shared.PluginError{Plugin: g.name, Topic: topic, Err: err}
+	}
+	return nil
+}
+
+func (g *guardedHandler) Close() error {
+	if closer, ok := g.handler.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (g *guardedHandler) stateChanged(state string) {
+	switch state {
+	case breakerOpen:
+		log.Errorf("plugin [%s] keeps failing, disabled for [%s]", g.name, g.breaker.cooldown)
+	case breakerClosed:
+		log.Infof("plugin [%s] recovered, enabled again", g.name)
+	}
+
+	select {
+	case g.health <- g.status(time.Now()):
+	default:
+	}
+}
+
+// pluginHealth is the health status of a plugin instance
+type pluginHealth struct {
+	name     string
+	state    string
+	calls    int64
+	failures int64
+	panics   int64
+	trips    int64
+	time     time.Time
+}
+
+func (g *guardedHandler) status(now time.Time) pluginHealth {
+	b := g.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return pluginHealth{
+		name:     g.name,
+		state:    b.state,
+		calls:    b.totalCalls,
+		failures: b.totalFailures,
+		panics:   b.totalPanics,
+		trips:    b.trips,
+		time:     now,
+	}
+}
+
+func (h pluginHealth) point() metrics.Point {
+	healthy := int64(1)
+	if h.state == breakerOpen {
+		healthy = 0
+	}
+
+	return metrics.Point{
+		Measurement: pluginHealthMeasurement,
+		Tags:        map[string]string{"plugin": h.name},
+		Fields: map[string]interface{}{
+			"state":    h.state,
+			"healthy":  healthy,
+			"calls":    h.calls,
+			"failures": h.failures,
+			"panics":   h.panics,
+			"trips":    h.trips,
+		},
+		Time: h.time,
+	}
+}
+
+// breaker counts the calls, failures and panics of the current window
+type breaker struct {
+	disabled        bool
+	window          time.Duration
+	minCalls        int
+	maxFailureRatio float64
+	maxPanics       int
+	cooldown        time.Duration
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+	calls       int
+	failures    int
+	panics      int
+
+	totalCalls    int64
+	totalFailures int64
+	totalPanics   int64
+	trips         int64
+}
+
+func newBreaker(cfg shared.PluginBreakerConfig) *breaker {
+	b := &breaker{
+		disabled:        cfg.Disabled,
+		window:          time.Duration(cfg.Window) * time.Second,
+		minCalls:        cfg.MinCalls,
+		maxFailureRatio: cfg.MaxFailureRatio,
+		maxPanics:       cfg.MaxPanics,
+		cooldown:        time.Duration(cfg.Cooldown) * time.Second,
+		state:           breakerClosed,
+	}
+	if cfg.Window <= 0 {
+		b.window = defaultBreakerWindow * time.Second
+	}
+	if cfg.MinCalls <= 0 {
+		b.minCalls = defaultBreakerMinCalls
+	}
+	if cfg.MaxFailureRatio <= 0 || cfg.MaxFailureRatio > 1 {
+		b.maxFailureRatio = defaultBreakerMaxFailureRatio
+	}
+	if cfg.MaxPanics <= 0 {
+		b.maxPanics = defaultBreakerMaxPanics
+	}
+	if cfg.Cooldown <= 0 {
+		b.cooldown = defaultBreakerCooldown * time.Second
+	}
+	return b
+}
+
+// allow reports whether the plugin may be called. Once the cooldown is over a single call
+// goes through to probe the plugin.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record accounts a call and returns the new state when it changed
+func (b *breaker) record(now time.Time, err error, panicked bool) (bool, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.totalCalls++
+	if err != nil {
+		b.totalFailures++
+	}
+	if panicked {
+		b.totalPanics++
+	}
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if err != nil {
+			b.trip(now)
+			return true, b.state
+		}
+		b.state = breakerClosed
+		b.resetWindow(now)
+		return true, b.state
+	}
+
+	if now.Sub(b.windowStart) >= b.window {
+		b.resetWindow(now)
+	}
+	b.calls++
+	if err != nil {
+		b.failures++
+	}
+	if panicked {
+		b.panics++
+	}
+
+	if b.disabled {
+		return false, b.state
+	}
+	if b.panics >= b.maxPanics ||
+		(b.calls >= b.minCalls && float64(b.failures)/float64(b.calls) >= b.maxFailureRatio) {
+		b.trip(now)
+		return true, b.state
+	}
+	return false, b.state
+}
+
+func (b *breaker) trip(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.trips++
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.calls = 0
+	b.failures = 0
+	b.panics = 0
+}
+
+// reportPluginHealth sends the health of every plugin to Telegraf periodically and on
+// every breaker state change, until ctx is cancelled
+func reportPluginHealth(ctx context.Context, guards []*guardedHandler, changes <-chan pluginHealth, telegrafChannel chan shared.TelegrafChannelMessage) {
+	ticker := time.NewTicker(pluginHealthReportInterval)
+	defer ticker.Stop()
+
+	send := func(h pluginHealth) bool {
+		select {
+		case telegrafChannel <- h.point():
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case h := <-changes:
+			if !send(h) {
+				return
+			}
+		case now := <-ticker.C:
+			for _, g := range guards {
+				if !send(g.status(now)) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -1,32 +1,155 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gomqttenc/plugins/external"
 	"gomqttenc/shared"
-	"plugin"
+	"strings"
 
 	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	// compiled-in plugins
+	_ "gomqttenc/plugins/jsonmap"
+	_ "gomqttenc/plugins/msh"
+	_ "gomqttenc/plugins/rtl433"
+	_ "gomqttenc/plugins/udp"
 )
 
-func loadMqttPlugin(name, path string) (shared.MqttPluginHandler, error) {
+// pluginCache loads each plugin once, however many topic tables reference it. Lifecycle
+// plugins get an instance per distinct options block. Every instance runs guarded by
+// panic recovery and its own circuit breaker.
+type pluginCache struct {
+	services *shared.PluginServices
+	breaker  shared.PluginBreakerConfig
+	loaded   map[string]shared.MqttPluginHandler
+	guards   []*guardedHandler
+	health   chan pluginHealth
+}
+
+func newPluginCache(services *shared.PluginServices, breaker shared.PluginBreakerConfig) *pluginCache {
+	return &pluginCache{
+		services: services,
+		breaker:  breaker,
+		loaded:   make(map[string]shared.MqttPluginHandler),
+		health:   make(chan pluginHealth, 16),
+	}
+}
+
+// handlers returns the plugin handlers of a topic table, in the order each filter lists
+// its plugins
+func (c *pluginCache) handlers(topics map[string]shared.PluginConfigs) (shared.MqttPluginHandlers, error) {
+	handlers := make(shared.MqttPluginHandlers)
+
+	for t, plugs := range topics {
+		for _, p := range plugs {
+			key := pluginKey(p)
+			handler, ok := c.loaded[key]
+			if !ok {
+				plugin, err := c.load(p)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load handler: Name: [%s] Path: [%s] Error: [%s]", p.Name, p.Path, err)
+				}
 
-	p, err := plugin.Open(path)
-	if err != nil {
-		log.Errorf("failed to open plugin: %v", err)
-		return nil, err
+				breaker := c.breaker
+				if p.Breaker != nil {
+					breaker = *p.Breaker
+				}
+				guard := newGuardedHandler(p.Name, plugin, breaker, c.health)
+				c.guards = append(c.guards, guard)
+				handler = guard
+				c.loaded[key] = handler
+			}
+			handlers[t] = append(handlers[t], handler)
+			log.Infof("Plugin: [%s] for Topic: [%s]", p.Name, t)
+		}
 	}
 
-	sym, err := p.Lookup("Handler")
-	if err != nil {
-		log.Errorf("failed to lookup Handler symbol: %v", err)
-		return nil, err
+	return handlers, nil
+}
+
+// close runs the Close hook of every plugin
+func (c *pluginCache) close() {
+	for key, handler := range c.loaded {
+		if closer, ok := handler.(interface{ Close() error }); ok {
+			if err := closer.Close(); err != nil {
+				log.Warnf("Plugin: [%s] close: %s", key, err)
+			}
+		}
+	}
+}
+
+// reportHealth sends the health of the loaded plugins to Telegraf until ctx is cancelled
+func (c *pluginCache) reportHealth(ctx context.Context, telegrafChannel chan shared.TelegrafChannelMessage) {
+	go reportPluginHealth(ctx, c.guards, c.health, telegrafChannel)
+}
+
+func pluginKey(p shared.PluginConfig) string {
+	key := p.Name + "@" + p.Path
+	if p.External != nil {
+		key = p.Name + "@" + strings.Join(p.External.Command, " ")
 	}
 
-	handler, ok := sym.(*shared.MqttPluginHandler)
-	if !ok {
-		log.Errorf("unexpected type from module symbol")
-		return nil, errors.New("unexpected type from module symbol")
+	var options bytes.Buffer
+	if err := json.Compact(&options, p.Options); err == nil && options.Len() > 0 {
+		key += "#" + options.String()
 	}
+	return key
+}
+
+// load starts the external plugin of p.External, opens the .so plugin of p.Path when
+// built with the goplugin tag and creates the compiled-in plugin named p.Name otherwise
+func (c *pluginCache) load(p shared.PluginConfig) (shared.MqttPluginHandler, error) {
+	if p.External != nil {
+		return external.New(p.Name, *p.External, p.Options, c.services.Telegraf)
+	}
+
+	var plugin shared.Plugin
+	if p.Path != "" && goPluginSupport {
+		factory, handler, err := loadMqttPlugin(p.Name, p.Path)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Plugin: [%s] loaded from [%s]", p.Name, p.Path)
+		if handler != nil {
+			if len(p.Options) > 0 {
+				log.Warnf("Plugin: [%s] predates the lifecycle API, options ignored", p.Name)
+			}
+			return handler, nil
+		}
+		plugin = factory()
+	} else {
+		if p.Path != "" {
+			log.Warnf("built without goplugin support, using compiled-in plugin [%s] instead of [%s]", p.Name, p.Path)
+		}
+		var err error
+		if plugin, err = shared.NewPlugin(p.Name); err != nil {
+			return nil, err
+		}
+		log.Infof("Plugin: [%s] compiled-in", p.Name)
+	}
+
+	if v := plugin.APIVersion(); v != shared.PluginAPIVersion {
+		return nil, fmt.Errorf("plugin API version [%d], this build supports [%d]", v, shared.PluginAPIVersion)
+	}
+	if err := plugin.Init(p.Options, c.services.ForPlugin(p.Name)); err != nil {
+		return nil, fmt.Errorf("init: %w", err)
+	}
+	return &lifecycleHandler{plugin: plugin}, nil
+}
+
+// lifecycleHandler runs a lifecycle plugin behind the MqttPluginHandler dispatch
+type lifecycleHandler struct {
+	plugin shared.Plugin
+}
+
+func (h *lifecycleHandler) Process(topic string, _ interface{}, msg mqtt.Message) error {
+	return h.plugin.Process(topic, msg)
+}
 
-	return *handler, nil
+func (h *lifecycleHandler) Close() error {
+	return h.plugin.Close()
 }
@@ -0,0 +1,47 @@
+//go:build goplugin
+
+package main
+
+import (
+	"errors"
+	"gomqttenc/shared"
+	"plugin"
+
+	"github.com/charmbracelet/log"
+)
+
+const goPluginSupport = true
+
+// loadMqttPlugin opens a .so plugin. It returns the NewPlugin factory of lifecycle plugins
+// and the Handler of plugins built before the lifecycle API.
+func loadMqttPlugin(name, path string) (func() shared.Plugin, shared.MqttPluginHandler, error) {
+
+	p, err := plugin.Open(path)
+	if err != nil {
+		log.Errorf("failed to open plugin: %v", err)
+		return nil, nil, err
+	}
+
+	if sym, err := p.Lookup("NewPlugin"); err == nil {
+		factory, ok := sym.(func() shared.Plugin)
+		if !ok {
+			log.Errorf("unexpected type from module symbol NewPlugin")
+			return nil, nil, errors.New("unexpected type from module symbol NewPlugin")
+		}
+		return factory, nil, nil
+	}
+
+	sym, err := p.Lookup("Handler")
+	if err != nil {
+		log.Errorf("failed to lookup NewPlugin or Handler symbol: %v", err)
+		return nil, nil, err
+	}
+
+	handler, ok := sym.(*shared.MqttPluginHandler)
+	if !ok {
+		log.Errorf("unexpected type from module symbol")
+		return nil, nil, errors.New("unexpected type from module symbol")
+	}
+
+	return nil, *handler, nil
+}
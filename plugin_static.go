@@ -0,0 +1,15 @@
+//go:build !goplugin
+
+package main
+
+import (
+	"errors"
+	"gomqttenc/shared"
+)
+
+// without the goplugin tag the binary can be linked statically, .so plugins need cgo
+const goPluginSupport = false
+
+func loadMqttPlugin(name, path string) (func() shared.Plugin, shared.MqttPluginHandler, error) {
+	return nil, nil, errors.New("built without goplugin support, rebuild with -tags goplugin to load .so plugins")
+}
@@ -0,0 +1,612 @@
+// Package external runs topic handlers written in any language as child processes. Each
+// message goes to the plugin's stdin as one line of JSON, with the Meshtastic envelope
+// decoded and decrypted when the keys allow it, and the plugin answers on stdout with one
+// line of JSON carrying the events to send to Telegraf. Every run of the plugin starts with
+// an init frame holding the options of its topic config, answered by ready before any
+// message is sent:
+//
+//	-> {"type":"init","id":1,"plugin":"py","options":{"measurement":"sensor"}}
+//	<- {"type":"ready","id":1}
+//	-> {"type":"message","id":2,"plugin":"py","topic":"msh/US/2/e/LongFast/!a1b2c3d4","payload":"<base64>","qos":0,"retain":false,"meta":{"channel_id":"LongFast","from":2712847316,"portnum":"TEXT_MESSAGE_APP","decoded":"<base64>"}}
+//	<- {"type":"result","id":2,"events":[{"measurement":"py_text","tags":{"channel":"LongFast"},"fields":{"len":5},"time":1700000000000000000}]}
+//	-> {"type":"ping","id":3}
+//	<- {"type":"pong","id":3}
+//
+// A ready or result carries "error" instead when the plugin failed, a failed init restarts
+// the plugin, an event without a
+// time is stamped by the publisher. Answers may come in any order, they are matched by id.
+// Whatever the plugin writes to stderr is logged. A plugin that exits or misses a health
+// check is restarted with an exponential backoff.
+package external
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gomqttenc/md"
+	"gomqttenc/metrics"
+	"gomqttenc/shared"
+	"gomqttenc/utils"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	DefaultTimeout         = 5000
+	DefaultHealthInterval  = 30
+	DefaultMaxRestartDelay = 30
+
+	stateMeasurement = "gomqttenc_external_plugin"
+	minRestartDelay  = time.Second
+	maxFrameSize     = 16 << 20
+	writeQueueSize   = 64
+)
+
+var (
+	ErrNotRunning = errors.New("plugin is not running")
+	ErrTimeout    = errors.New("plugin timed out")
+)
+
+// messageFrame is a message handed to the plugin
+type messageFrame struct {
+	Type       string            `json:"type"`
+	ID         uint64            `json:"id"`
+	Plugin     string            `json:"plugin"`
+	Topic      string            `json:"topic"`
+	Payload    []byte            `json:"payload"`
+	QoS        byte              `json:"qos"`
+	Retain     bool              `json:"retain"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Meta       *Meta             `json:"meta,omitempty"`
+}
+
+// initFrame hands the plugin its options, once per run
+type initFrame struct {
+	Type    string          `json:"type"`
+	ID      uint64          `json:"id"`
+	Plugin  string          `json:"plugin"`
+	Options json.RawMessage `json:"options"`
+}
+
+type pingFrame struct {
+	Type string `json:"type"`
+	ID   uint64 `json:"id"`
+}
+
+// responseFrame is a ready, result or pong sent back by the plugin
+type responseFrame struct {
+	Type   string  `json:"type"`
+	ID     uint64  `json:"id"`
+	Events []Event `json:"events"`
+	Error  string  `json:"error"`
+}
+
+// Meta is the decoded Meshtastic envelope of a message. Decoded is the decrypted Data
+// payload, only set when a channel key matched.
+type Meta struct {
+	ChannelID string  `json:"channel_id,omitempty"`
+	GatewayID string  `json:"gateway_id,omitempty"`
+	From      uint32  `json:"from,omitempty"`
+	To        uint32  `json:"to,omitempty"`
+	PacketID  uint32  `json:"packet_id,omitempty"`
+	Channel   uint32  `json:"channel,omitempty"`
+	HopLimit  uint32  `json:"hop_limit,omitempty"`
+	RxTime    uint32  `json:"rx_time,omitempty"`
+	RxRSSI    int32   `json:"rx_rssi,omitempty"`
+	RxSNR     float32 `json:"rx_snr,omitempty"`
+	PortNum   string  `json:"portnum,omitempty"`
+	Decoded   []byte  `json:"decoded,omitempty"`
+}
+
+// Event is a record returned by a plugin. Time is in unix nanoseconds, 0 means now.
+type Event struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        int64                  `json:"time"`
+}
+
+// Plugin is a shared.MqttPluginHandler backed by a supervised child process
+type Plugin struct {
+	name            string
+	cfg             shared.ExternalPluginConfig
+	options         json.RawMessage
+	timeout         time.Duration
+	healthInterval  time.Duration
+	maxRestartDelay time.Duration
+	telegrafChannel chan shared.TelegrafChannelMessage
+
+	ctx  context.Context
+	stop context.CancelFunc
+	done chan struct{}
+
+	nextID   atomic.Uint64
+	restarts atomic.Int64
+	timeouts atomic.Int64
+
+	mu   sync.RWMutex
+	proc *process
+}
+
+// New starts the plugin process and keeps it running until Close. options are sent to each
+// run of the process in its init frame, state changes are reported to telegrafChannel.
+func New(name string, cfg shared.ExternalPluginConfig, options json.RawMessage, telegrafChannel chan shared.TelegrafChannelMessage) (*Plugin, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("external plugin [%s] has no command", name)
+	}
+	if _, err := exec.LookPath(cfg.Command[0]); err != nil {
+		return nil, fmt.Errorf("external plugin [%s]: %w", name, err)
+	}
+
+	p := &Plugin{
+		name:            name,
+		cfg:             cfg,
+		options:         options,
+		timeout:         time.Duration(cfg.Timeout) * time.Millisecond,
+		healthInterval:  time.Duration(cfg.HealthInterval) * time.Second,
+		maxRestartDelay: time.Duration(cfg.MaxRestartDelay) * time.Second,
+		telegrafChannel: telegrafChannel,
+		done:            make(chan struct{}),
+	}
+	if cfg.Timeout <= 0 {
+		p.timeout = DefaultTimeout * time.Millisecond
+	}
+	if cfg.HealthInterval <= 0 {
+		p.healthInterval = DefaultHealthInterval * time.Second
+	}
+	if cfg.MaxRestartDelay <= 0 {
+		p.maxRestartDelay = DefaultMaxRestartDelay * time.Second
+	}
+	p.maxRestartDelay = max(p.maxRestartDelay, minRestartDelay)
+	if len(p.options) == 0 {
+		p.options = json.RawMessage("{}")
+	}
+
+	p.ctx, p.stop = context.WithCancel(context.Background())
+	go p.supervise()
+
+	log.Infof("external plugin [%s] runs %v, timeout [%s]", name, cfg.Command, p.timeout)
+	return p, nil
+}
+
+// Close stops the plugin process
+func (p *Plugin) Close() error {
+	p.stop()
+	<-p.done
+	return nil
+}
+
+func (p *Plugin) Process(name string, data interface{}, msg mqtt.Message) error {
+	ctx, ok := data.(*shared.MqttMessageHandlerContext)
+	if !ok {
+		return errors.New("failed to cast expected data to MqttMessageHandlerContext")
+	}
+	telegrafChan, ok := (ctx.TelegrafChan).(chan shared.TelegrafChannelMessage)
+	if !ok {
+		return errors.New("failed to cast expected data to chan shared.TelegrafChannelMessage")
+	}
+
+	p.mu.RLock()
+	proc := p.proc
+	p.mu.RUnlock()
+	if proc == nil {
+		return fmt.Errorf("external plugin [%s]: %w", p.name, ErrNotRunning)
+	}
+
+	id := p.nextID.Add(1)
+	resp, err := proc.call(id, messageFrame{
+		Type:       "message",
+		ID:         id,
+		Plugin:     p.name,
+		Topic:      msg.Topic(),
+		Payload:    msg.Payload(),
+		QoS:        msg.Qos(),
+		Retain:     msg.Retained(),
+		Properties: shared.UserProperties(msg),
+		Meta:       decodeMeta(msg.Payload(), ctx),
+	}, p.timeout)
+	if errors.Is(err, ErrTimeout) {
+		p.timeouts.Add(1)
+	}
+	if err != nil {
+		return fmt.Errorf("external plugin [%s]: %w", p.name, err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("external plugin [%s]: %s", p.name, resp.Error)
+	}
+
+	for _, event := range resp.Events {
+		point, err := event.point()
+		if err != nil {
+			log.Warnf("external plugin [%s]: dropping event: %s", p.name, err)
+			continue
+		}
+		telegrafChan <- point
+	}
+	return nil
+}
+
+// supervise runs the plugin process, restarting it whenever it exits
+func (p *Plugin) supervise() {
+	defer close(p.done)
+
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		proc, err := p.start()
+		if err == nil {
+			if err = p.initialize(proc); err != nil {
+				proc.kill()
+				<-proc.exited
+			}
+		}
+		if err != nil {
+			log.Errorf("external plugin [%s] failed to start: %s", p.name, err)
+		} else {
+			p.setProcess(proc)
+			p.report("started")
+			go p.checkHealth(proc)
+
+			select {
+			case <-proc.exited:
+			case <-p.ctx.Done():
+				proc.kill()
+				<-proc.exited
+				p.setProcess(nil)
+				return
+			}
+			p.setProcess(nil)
+			log.Warnf("external plugin [%s] exited: %v", p.name, proc.err)
+			p.report("exited")
+		}
+
+		// a plugin that ran for a while starts over with the shortest delay
+		if time.Since(started) > p.maxRestartDelay {
+			delay = minRestartDelay
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, p.maxRestartDelay)
+		p.restarts.Add(1)
+		log.Infof("restarting external plugin [%s]", p.name)
+	}
+}
+
+// initialize sends the options to a new process and waits for it to be ready
+func (p *Plugin) initialize(proc *process) error {
+	id := p.nextID.Add(1)
+	resp, err := proc.call(id, initFrame{Type: "init", ID: id, Plugin: p.name, Options: p.options}, p.timeout)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("init: %s", resp.Error)
+	}
+	return nil
+}
+
+func (p *Plugin) setProcess(proc *process) {
+	p.mu.Lock()
+	p.proc = proc
+	p.mu.Unlock()
+}
+
+// checkHealth pings the process and kills it when it does not answer in time
+func (p *Plugin) checkHealth(proc *process) {
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-proc.exited:
+			return
+		case <-ticker.C:
+			id := p.nextID.Add(1)
+			if _, err := proc.call(id, pingFrame{Type: "ping", ID: id}, p.timeout); err != nil {
+				if errors.Is(err, ErrNotRunning) {
+					return
+				}
+				log.Warnf("external plugin [%s] failed its health check: %s", p.name, err)
+				p.report("unhealthy")
+				proc.kill()
+				return
+			}
+		}
+	}
+}
+
+// report sends the plugin state to Telegraf
+func (p *Plugin) report(state string) {
+	running := int64(0)
+	if state == "started" {
+		running = 1
+	}
+
+	point := metrics.Point{
+		Measurement: stateMeasurement,
+		Tags:        map[string]string{"plugin": p.name},
+		Fields: map[string]interface{}{
+			"state":    state,
+			"running":  running,
+			"restarts": p.restarts.Load(),
+			"timeouts": p.timeouts.Load(),
+		},
+		Time: time.Now(),
+	}
+
+	select {
+	case p.telegrafChannel <- point:
+	case <-p.ctx.Done():
+	}
+}
+
+// process is one run of the plugin command
+type process struct {
+	name   string
+	cmd    *exec.Cmd
+	writes chan []byte
+
+	mu      sync.Mutex
+	pending map[uint64]chan responseFrame
+
+	exited chan struct{}
+	err    error
+}
+
+func (p *Plugin) start() (*process, error) {
+	cmd := exec.Command(p.cfg.Command[0], p.cfg.Command[1:]...)
+	cmd.Dir = p.cfg.Dir
+	cmd.Env = append(os.Environ(), p.cfg.Env...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	proc := &process{
+		name:    p.name,
+		cmd:     cmd,
+		writes:  make(chan []byte, writeQueueSize),
+		pending: make(map[uint64]chan responseFrame),
+		exited:  make(chan struct{}),
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		proc.readResponses(stdout)
+	}()
+	go func() {
+		defer readers.Done()
+		proc.logStderr(stderr)
+	}()
+	go proc.writeRequests(stdin)
+
+	// Wait must only be called once the pipes are read to the end
+	go func() {
+		readers.Wait()
+		proc.err = cmd.Wait()
+		close(proc.exited)
+	}()
+
+	log.Infof("external plugin [%s] started, pid [%d]", p.name, cmd.Process.Pid)
+	return proc, nil
+}
+
+func (proc *process) kill() {
+	if err := proc.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Warnf("external plugin [%s] kill: %s", proc.name, err)
+	}
+}
+
+// call sends a frame and waits for the answer with the same id
+func (proc *process) call(id uint64, frame interface{}, timeout time.Duration) (responseFrame, error) {
+	line, err := json.Marshal(frame)
+	if err != nil {
+		return responseFrame{}, err
+	}
+	line = append(line, '\n')
+
+	answer := make(chan responseFrame, 1)
+	proc.mu.Lock()
+	proc.pending[id] = answer
+	proc.mu.Unlock()
+	defer func() {
+		proc.mu.Lock()
+		delete(proc.pending, id)
+		proc.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case proc.writes <- line:
+	case <-timer.C:
+		return responseFrame{}, ErrTimeout
+	case <-proc.exited:
+		return responseFrame{}, ErrNotRunning
+	}
+
+	select {
+	case resp := <-answer:
+		return resp, nil
+	case <-timer.C:
+		return responseFrame{}, ErrTimeout
+	case <-proc.exited:
+		return responseFrame{}, ErrNotRunning
+	}
+}
+
+// writeRequests serialises the frames to stdin, a stuck plugin only blocks this goroutine
+func (proc *process) writeRequests(stdin io.WriteCloser) {
+	defer stdin.Close()
+	for {
+		select {
+		case <-proc.exited:
+			return
+		case line := <-proc.writes:
+			if _, err := stdin.Write(line); err != nil {
+				log.Warnf("external plugin [%s] write: %s", proc.name, err)
+				proc.kill()
+				return
+			}
+		}
+	}
+}
+
+func (proc *process) readResponses(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFrameSize)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var resp responseFrame
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&resp); err != nil {
+			log.Warnf("external plugin [%s] sent an invalid frame: %s [%s]", proc.name, err, utils.TrimNonPrintable(string(line)))
+			continue
+		}
+
+		proc.mu.Lock()
+		answer, ok := proc.pending[resp.ID]
+		proc.mu.Unlock()
+		if !ok {
+			log.Debugf("external plugin [%s] answered [%d] after its timeout", proc.name, resp.ID)
+			continue
+		}
+		answer <- resp
+	}
+	if err := scanner.Err(); err != nil {
+		log.Warnf("external plugin [%s] read: %s", proc.name, err)
+		proc.kill()
+		// drain so the process does not block on a full pipe before it dies
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+}
+
+func (proc *process) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Infof("external plugin [%s]: %s", proc.name, scanner.Text())
+	}
+}
+
+// point converts the event to a Telegraf point. JSON numbers without a fraction become
+// integer fields.
+func (e Event) point() (metrics.Point, error) {
+	if e.Measurement == "" {
+		return metrics.Point{}, errors.New("event without measurement")
+	}
+
+	fields := make(map[string]interface{}, len(e.Fields))
+	for k, v := range e.Fields {
+		switch f := v.(type) {
+		case json.Number:
+			if i, err := f.Int64(); err == nil {
+				fields[k] = i
+			} else if x, err := f.Float64(); err == nil {
+				fields[k] = x
+			} else {
+				return metrics.Point{}, fmt.Errorf("field [%s] of [%s]: %w", k, e.Measurement, err)
+			}
+		case string, bool:
+			fields[k] = f
+		default:
+			return metrics.Point{}, fmt.Errorf("field [%s] of [%s] is not a number, string or bool", k, e.Measurement)
+		}
+	}
+
+	point := metrics.Point{
+		Measurement: e.Measurement,
+		Tags:        e.Tags,
+		Fields:      fields,
+	}
+	if e.Time != 0 {
+		point.Time = time.Unix(0, e.Time)
+	}
+	return point, nil
+}
+
+// decodeMeta decodes a ServiceEnvelope or a bare MeshPacket and decrypts it with the
+// channel key when one is configured. Other payloads have no metadata.
+func decodeMeta(payload []byte, ctx *shared.MqttMessageHandlerContext) *Meta {
+	if utils.IsLikelyJSON(payload) {
+		return nil
+	}
+
+	var meta Meta
+	var packet *meshtastic.MeshPacket
+	var key shared.Key
+	var hasKey bool
+
+	var env meshtastic.ServiceEnvelope
+	if err := proto.Unmarshal(payload, &env); err == nil && env.GetPacket().GetFrom() != 0 {
+		packet = env.GetPacket()
+		meta.ChannelID = env.GetChannelId()
+		meta.GatewayID = env.GetGatewayId()
+		key, hasKey = ctx.ChannelKeys[meta.ChannelID]
+	} else {
+		var mesh meshtastic.MeshPacket
+		if err := proto.Unmarshal(payload, &mesh); err != nil || mesh.GetFrom() == 0 {
+			return nil
+		}
+		packet = &mesh
+		key, hasKey = ctx.ChannelKeysByChannelNum[mesh.GetChannel()]
+	}
+
+	meta.From = packet.GetFrom()
+	meta.To = packet.GetTo()
+	meta.PacketID = packet.GetId()
+	meta.Channel = packet.GetChannel()
+	meta.HopLimit = packet.GetHopLimit()
+	meta.RxTime = packet.GetRxTime()
+	meta.RxRSSI = packet.GetRxRssi()
+	meta.RxSNR = packet.GetRxSnr()
+
+	// PKI packets need both node keys, leave them to the plugin
+	if packet.GetDecoded() == nil && (!hasKey || packet.GetPkiEncrypted() || strings.EqualFold(meta.ChannelID, "PKI")) {
+		return &meta
+	}
+	data, err := md.TryDecode(packet, []shared.Key{key}, md.DecryptChannel)
+	if err != nil {
+		return &meta
+	}
+	meta.PortNum = data.GetPortnum().String()
+	meta.Decoded = data.GetPayload()
+
+	return &meta
+}
@@ -0,0 +1,77 @@
+package jsonmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gomqttenc/mapping"
+	"gomqttenc/shared"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	ErrNoMappings  = errors.New("the json plugin needs mapping rules")
+	ErrJSONPayload = errors.New("failed to decode JSON payload")
+)
+
+// MshMqttHandler exports JSON payloads following the mapping rules of their topic
+type MshMqttHandler struct {
+	services *shared.PluginServices
+	mapper   *mapping.Mapper
+}
+
+// New returns an instance of the plugin, also exported as NewPlugin by its .so build
+func New() shared.Plugin {
+	return &MshMqttHandler{}
+}
+
+func (m *MshMqttHandler) APIVersion() int {
+	return shared.PluginAPIVersion
+}
+
+// Init takes no options, the rules come from the mappings config
+func (m *MshMqttHandler) Init(config json.RawMessage, services *shared.PluginServices) error {
+	m.services = services
+	if err := shared.DecodePluginOptions(config, &struct{}{}); err != nil {
+		return err
+	}
+
+	mapper, err := mapping.New(services.Mappings)
+	if err != nil {
+		return err
+	}
+	if mapper == nil {
+		return ErrNoMappings
+	}
+	m.mapper = mapper
+	return nil
+}
+
+func (m *MshMqttHandler) Process(topic string, msg mqtt.Message) error {
+	doc, err := mapping.FromJSON(msg.Payload())
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrJSONPayload, err)
+	}
+
+	points := m.mapper.Map(mapping.Input{
+		Topic: msg.Topic(),
+		Doc:   doc,
+	})
+	if len(points) == 0 {
+		log.Debugf("no mapping rule exported [%s]", msg.Topic())
+	}
+	for _, point := range points {
+		m.services.Telegraf <- point
+	}
+	return nil
+}
+
+func (m *MshMqttHandler) Close() error {
+	return nil
+}
+
+func init() {
+	shared.RegisterPlugin("json", New)
+}
@@ -0,0 +1,74 @@
+package msh
+
+import (
+	"errors"
+	"fmt"
+	"gomqttenc/mapping"
+	"gomqttenc/metrics"
+	"gomqttenc/parser"
+	"gomqttenc/position"
+	"gomqttenc/shared"
+	"gomqttenc/tak"
+	"time"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// handleJSONUplink decodes a packet a node uplinked in JSON into the messages of the
+// protobuf path. The mapping rules see the whole uplink, payload and reception included,
+// the points mapped from a position are dropped when the position filter rejects it.
+func handleJSONUplink(msg mqtt.Message, topic parser.MeshTopic, telegrafChannel chan shared.TelegrafChannelMessage, transform shared.MessageTransform, poster *tak.Poster, identities *tak.IdentityRegistry, positionFilter *position.Filter, mapper *mapping.Mapper) error {
+	uplink, err := parser.ParseJSONMessage(msg.Payload())
+	if err != nil {
+		log.Warnf("Failed to parse JSON uplink: Topic: [%s], %v", msg.Topic(), err)
+		return fmt.Errorf("%w: %w", shared.ErrMeshHandlerError, err)
+	}
+
+	portnum := uplink.Portnum()
+	log.Info("JSON uplink", "type", uplink.Type, "portnum", portnum.String(), "source", fmt.Sprintf("%x", uplink.From), "dest", fmt.Sprintf("%x", uplink.To), "gateway", uplink.Sender, "topic", msg.Topic())
+
+	messageEnv := uplink.Envelope(msg.Topic(), shared.UserProperties(msg))
+	messageEnv.SetMeshTopic(topic)
+
+	var mapped []metrics.Point
+	if mapper != nil {
+		doc, err := mapping.FromJSON(msg.Payload())
+		if err != nil {
+			return fmt.Errorf("%w: %w", shared.ErrMeshHandlerError, err)
+		}
+		tags := messageEnv.TopicTags()
+		tags["device"] = fmt.Sprintf("%x", uplink.From)
+		in := mapping.Input{
+			Portnum: portnum.String(),
+			Topic:   msg.Topic(),
+			Doc:     doc,
+			Tags:    tags,
+		}
+		if uplink.Timestamp > 0 {
+			in.Time = time.Unix(uplink.Timestamp, 0)
+		}
+		mapped = mapper.Map(in)
+		if !hasPosition(portnum) {
+			for _, point := range mapped {
+				telegrafChannel <- point
+			}
+			mapped = nil
+		}
+	}
+
+	event, err := uplink.Event(messageEnv)
+	if errors.Is(err, parser.ErrUnsupportedJSONType) {
+		log.Debugf("%s, not exported", err)
+		return nil
+	}
+	if err != nil {
+		log.Warnf("parse error: %s", err)
+		return fmt.Errorf("%w: %w", shared.ErrMeshHandlerError, err)
+	}
+
+	if text, ok := event.(*parser.TextMessage); ok {
+		return parser.ProcessTextMessage(telegrafChannel, text.Parsed, messageEnv)
+	}
+	return publishEvent(event, mapped, telegrafChannel, transform, poster, identities, positionFilter)
+}
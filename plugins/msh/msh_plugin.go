@@ -1,16 +1,18 @@
-package main
+package msh
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"gomqttenc/mapping"
 	"gomqttenc/md"
+	"gomqttenc/metrics"
 	"gomqttenc/parser"
+	"gomqttenc/position"
 	"gomqttenc/shared"
 	"gomqttenc/tak"
 	"gomqttenc/utils"
-	"strconv"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -19,35 +21,65 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-type MshMqttHandler struct{}
+type MshMqttHandler struct {
+	services *shared.PluginServices
+	mapper   *mapping.Mapper
+}
 
-func (m MshMqttHandler) Process(name string, data interface{}, msg mqtt.Message) error {
+// New returns an instance of the plugin, also exported as NewPlugin by its .so build
+func New() shared.Plugin {
+	return &MshMqttHandler{}
+}
 
-	ctx, ok := data.(*shared.MqttMessageHandlerContext)
-	if !ok {
-		log.Fatal("failed to cast expected data to MqttMessageHandlerContext")
+func (m *MshMqttHandler) APIVersion() int {
+	return shared.PluginAPIVersion
+}
+
+// Init takes no options, decoded payloads are also exported following the mapping rules
+func (m *MshMqttHandler) Init(config json.RawMessage, services *shared.PluginServices) error {
+	m.services = services
+	if err := shared.DecodePluginOptions(config, &struct{}{}); err != nil {
+		return err
 	}
 
-	telegrafChan, ok := (ctx.TelegrafChan).(chan shared.TelegrafChannelMessage)
-	if !ok {
-		log.Fatal("failed to cast expected data to chan shared.TelegrafChannelMessage")
+	mapper, err := mapping.New(services.Mappings)
+	if err != nil {
+		return err
 	}
+	m.mapper = mapper
+	return nil
+}
 
-	return handleMeshtasticTopics(msg, telegrafChan, ctx.ChannelKeys, ctx.TAKServer, ctx.TAKCerts.TLSClientConfig)
+func (m *MshMqttHandler) Process(topic string, msg mqtt.Message) error {
+	s := m.services
+	return handleMeshtasticTopics(msg, s.Telegraf, s.Transform, s.Keys.ByName, s.TAK, s.Identities, s.PositionFilter, m.mapper)
+}
 
+func (m *MshMqttHandler) Close() error {
+	return nil
 }
 
-func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.TelegrafChannelMessage, channelKeys map[string]shared.Key, TAKServer string, tlsConfig *tls.Config) error {
+func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.TelegrafChannelMessage, transform shared.MessageTransform, channelKeys map[string]shared.Key, poster *tak.Poster, identities *tak.IdentityRegistry, positionFilter *position.Filter, mapper *mapping.Mapper) error {
 
-	// TODO DEBUG JSON guessing ...
+	topic, err := parser.ParseMeshTopic(msg.Topic())
+	if err != nil {
+		log.Debugf("%s, handled as a protobuf uplink", err)
+	}
 
+	switch topic.Format {
+	case parser.FormatStat:
+		return handleGatewayStatus(msg, topic, telegrafChannel)
+	case parser.FormatJSON:
+		return handleJSONUplink(msg, topic, telegrafChannel, transform, poster, identities, positionFilter, mapper)
+	}
+
+	// JSON uplinks to topics outside the Meshtastic grammar
 	if utils.IsLikelyJSON(msg.Payload()) {
-		log.Warnf("msg is likely JSON: [%s]", msg.Payload())
-		return nil
+		return handleJSONUplink(msg, topic, telegrafChannel, transform, poster, identities, positionFilter, mapper)
 	}
 
 	var env meshtastic.ServiceEnvelope
-	err := proto.Unmarshal(msg.Payload(), &env)
+	err = proto.Unmarshal(msg.Payload(), &env)
 	if err != nil {
 		log.Warnf("Failed to parse MeshPacket: Topic: [%s],  %v", msg.Topic(), err)
 		return shared.ErrMeshHandlerError
@@ -67,7 +99,11 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 	// if it's a PKI message use the device ID to decrypt
 	var privKeys []shared.Key
 
-	if env.ChannelId == "PKI" {
+	if env.Packet.GetDecoded() != nil {
+		// map reports and unencrypted uplinks carry the packet decoded
+		log.Debugf("packet [%x] is not encrypted", env.Packet.Id)
+
+	} else if env.ChannelId == "PKI" {
 
 		encPacket := env.Packet.GetEncrypted()
 		log.Infof("ServicePacket Payload [%s]:[%d]", hex.EncodeToString(encPacket), len(encPacket))
@@ -83,16 +119,17 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 
 		toAddrKey, ok := channelKeys[toAddr]
 		if !ok {
-			log.Errorf("PKI: no private key found for toAddr: [%s]", toAddr)
-			return shared.ErrMeshHandlerError
+			// traffic of channels and nodes without a key is expected, not a failure
+			log.Debugf("PKI: no private key found for toAddr: [%s], not decoded", toAddr)
+			return nil
 		}
 		privKeys = append(privKeys, toAddrKey)
 		log.Debugf("retrieving TO key for %s [%s]", toAddr, toAddrKey.Txt)
 
 		fromAddrKey, ok := channelKeys[fromAddr]
 		if !ok {
-			log.Errorf("PKI: no private key found for fromAddr: [%s]", fromAddr)
-			return shared.ErrMeshHandlerError
+			log.Debugf("PKI: no private key found for fromAddr: [%s], not decoded", fromAddr)
+			return nil
 		}
 
 		privKeys = append(privKeys, fromAddrKey)
@@ -102,8 +139,8 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 		log.Debugf("retrieving key for %s", env.ChannelId)
 		privKey, ok := channelKeys[env.ChannelId]
 		if !ok {
-			log.Errorf("no private key found for ChannelId: [%s]", env.ChannelId)
-			return shared.ErrMeshHandlerError
+			log.Debugf("no private key found for ChannelId: [%s], not decoded", env.ChannelId)
+			return nil
 		}
 		log.Debugf("Decoding with key [%s]", privKey.Txt)
 
@@ -111,8 +148,13 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 
 	}
 
+	channel := topic.Channel
+	if channel == "" {
+		channel = utils.GetNthTopicSegmentFromEnd(msg.Topic(), 1)
+	}
+
 	var decryptType md.DecryptType
-	switch utils.GetNthTopicSegmentFromEnd(msg.Topic(), 1) {
+	switch channel {
 	case "PKI":
 		decryptType = md.DecryptDirect
 	default:
@@ -121,10 +163,10 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 	messagePtr, err := md.TryDecode(env.Packet, privKeys, decryptType)
 	if err != nil {
 		log.Error("failed to decode packet", "err", err, "payload", hex.EncodeToString(msg.Payload()))
-		return shared.ErrMeshHandlerError
+		return fmt.Errorf("%w: %w", shared.ErrMeshHandlerError, err)
 	}
 
-	if out, _, err := shared.ProcessMessage(messagePtr); err != nil {
+	if out, obj, err := shared.ProcessMessage(messagePtr); err != nil {
 		if messagePtr.Portnum != 0 {
 			log.Error("failed to process message", "err", err, "source", messagePtr.Source, "dest", messagePtr.Dest, "payload", hex.EncodeToString(msg.Payload()), "topic", msg.Topic(), "channel", env.ChannelId, "portnum", messagePtr.Portnum.String())
 		}
@@ -134,10 +176,32 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 
 		log.Debugf("parsing [%s]", out)
 		messageEnv := parser.MessageEnvelope{
-			Device: env.Packet.From,
-			From:   env.Packet.From,
-			To:     env.Packet.To,
-			Topic:  msg.Topic(),
+			Device:     env.Packet.From,
+			From:       env.Packet.From,
+			To:         env.Packet.To,
+			Topic:      msg.Topic(),
+			Properties: shared.UserProperties(msg),
+			Gateway:    env.GatewayId,
+			RSSI:       int(env.Packet.RxRssi),
+			SNR:        float64(env.Packet.RxSnr),
+		}
+		if env.Packet.HopStart >= env.Packet.HopLimit {
+			messageEnv.HopsAway = int(env.Packet.HopStart - env.Packet.HopLimit)
+		}
+		messageEnv.SetMeshTopic(topic)
+
+		tags := messageEnv.TopicTags()
+		tags["device"] = fmt.Sprintf("%x", env.Packet.From)
+		mapped := mapper.MapDecoded(mapping.Input{
+			Portnum: messagePtr.Portnum.String(),
+			Topic:   msg.Topic(),
+			Tags:    tags,
+		}, obj)
+		if !hasPosition(messagePtr.Portnum) {
+			for _, point := range mapped {
+				telegrafChannel <- point
+			}
+			mapped = nil
 		}
 
 		switch messagePtr.Portnum {
@@ -148,16 +212,8 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 				return shared.ErrMeshHandlerError
 			}
 			log.Debugf("Parsed NodeInfo Report Message:\n%+v\n", parsed)
-
-			telegrafChannel <- parser.NodeInfoMessage{
-				Envelope:  messageEnv,
-				Id:        parsed.Id,
-				LongName:  parsed.LongName,
-				ShortName: parsed.ShortName,
-				MACaddr:   parsed.MACaddr,
-				HWModel:   parsed.HWModel,
-				PublicKey: parsed.PublicKey,
-			}
+			parsed.Envelope = messageEnv
+			return publishEvent(*parsed, mapped, telegrafChannel, transform, poster, identities, positionFilter)
 
 		case meshtastic.PortNum_MAP_REPORT_APP:
 			parsed, err := parser.ParseMapReportMessage(out)
@@ -166,44 +222,8 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 				return shared.ErrMeshHandlerError
 			}
 			log.Infof("Parsed Map Report Message:\n%+v\n", parsed)
-
-			telegrafChannel <- parser.MapReportMessage{
-				Envelope:            messageEnv,
-				LongName:            parsed.LongName,
-				ShortName:           parsed.ShortName,
-				HwModel:             parsed.HwModel,
-				FirmwareVersion:     parsed.FirmwareVersion,
-				Region:              parsed.Region,
-				HasDefaultChannel:   parsed.HasDefaultChannel,
-				LatitudeI:           parsed.LatitudeI,
-				LongitudeI:          parsed.LongitudeI,
-				Altitude:            parsed.Altitude,
-				PositionPrecision:   parsed.PositionPrecision,
-				NumOnlineLocalNodes: parsed.NumOnlineLocalNodes,
-			}
-
-			serial, err := strconv.Atoi(parsed.ShortName)
-			if err != nil {
-				fmt.Printf("Error converting %s to int: %s", parsed.ShortName, err)
-				return shared.ErrMeshHandlerError
-			}
-
-			respBody, err := tak.PostTelemetryTAK(context.Background(),
-				TAKServer, tlsConfig, tak.Telemetry{
-					SerialNumber: float64(serial),
-					DateTime:     time.Now(),
-					Latitude:     float64(parsed.LatitudeI) / 10_000_000.0,
-					Longitude:    float64(parsed.LongitudeI) / 10_000_000.0,
-					Event:        0,
-					SolarPower:   0.0,
-					Speed:        0.0,
-					Heading:      0,
-				}, true)
-			if err != nil {
-				log.Errorf("failed to post to TAK Server: %s", err)
-				return err
-			}
-			log.Infof("MAP: POST to TAK Server: %s", respBody)
+			parsed.Envelope = messageEnv
+			return publishEvent(*parsed, mapped, telegrafChannel, transform, poster, identities, positionFilter)
 
 		case meshtastic.PortNum_POSITION_APP:
 			parsed, err := parser.ParsePositionMessage(out)
@@ -211,38 +231,8 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 				fmt.Println("Error:", err)
 				return shared.ErrMeshHandlerError
 			}
-
-			telegrafChannel <- parser.PositionMessage{
-				Envelope:       messageEnv,
-				LatitudeI:      parsed.LatitudeI,
-				LongitudeI:     parsed.LongitudeI,
-				Altitude:       parsed.Altitude,
-				Time:           parsed.Time,
-				LocationSource: parsed.LocationSource,
-				Timestamp:      parsed.Timestamp,
-				SeqNumber:      parsed.SeqNumber,
-				SatsInView:     parsed.SatsInView,
-				GroundSpeed:    parsed.GroundSpeed,
-				GroundTrack:    parsed.GroundTrack,
-				PrecisionBits:  parsed.PrecisionBits,
-			}
-
-			respBody, err := tak.PostTelemetryTAK(context.Background(),
-				TAKServer, tlsConfig, tak.Telemetry{
-					SerialNumber: float64(messageEnv.From),
-					DateTime:     time.Now(),
-					Latitude:     float64(parsed.LatitudeI) / 10_000_000.0,
-					Longitude:    float64(parsed.LongitudeI) / 10_000_000.0,
-					Event:        0,
-					SolarPower:   0.0,
-					Speed:        0.0,
-					Heading:      0,
-				}, true)
-			if err != nil {
-				log.Errorf("failed to post to TAK Server: %s", err)
-				return err
-			}
-			log.Infof("POSITION: POST to TAK Server: %s", respBody)
+			parsed.Envelope = messageEnv
+			return publishEvent(*parsed, mapped, telegrafChannel, transform, poster, identities, positionFilter)
 
 		case meshtastic.PortNum_TEXT_MESSAGE_APP:
 
@@ -267,24 +257,13 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 
 				switch v := parsed.Parsed.(type) {
 				case parser.DeviceMetrics:
-
-					telegrafChannel <- parser.DeviceMetrics{
-						Envelope:           messageEnv,
-						BatteryLevel:       v.BatteryLevel,
-						Voltage:            v.Voltage,
-						ChannelUtilization: v.ChannelUtilization,
-						AirUtilTx:          v.AirUtilTx,
-						UptimeSeconds:      v.UptimeSeconds,
-					}
+					v.Envelope = messageEnv
+					return publishEvent(v, mapped, telegrafChannel, transform, poster, identities, positionFilter)
 
 				case parser.EnvironmentMetrics:
 					log.Infof("EnvironmentMetrics - Temp: %f Humidity: %f", v.Temperature, v.RelativeHumidity)
-
-					telegrafChannel <- parser.EnvironmentMetrics{
-						Envelope:         messageEnv,
-						Temperature:      v.Temperature,
-						RelativeHumidity: v.RelativeHumidity,
-					}
+					v.Envelope = messageEnv
+					return publishEvent(v, mapped, telegrafChannel, transform, poster, identities, positionFilter)
 
 				default:
 					fmt.Println("Unknown type")
@@ -296,5 +275,129 @@ func handleMeshtasticTopics(msg mqtt.Message, telegrafChannel chan shared.Telegr
 	return nil
 }
 
-// This symbol will be looked up
-var Handler shared.MqttPluginHandler = MshMqttHandler{}
+// hasPosition reports whether packets of portnum carry a position, their mapped points are
+// held back until the position filter accepted it
+func hasPosition(portnum meshtastic.PortNum) bool {
+	return portnum == meshtastic.PortNum_POSITION_APP || portnum == meshtastic.PortNum_MAP_REPORT_APP
+}
+
+// publishEvent sends a decoded message and the points mapped from it to Telegraf. Node
+// names feed the TAK identities, positions that pass the filter and telemetry are posted
+// to TAK as well. The message goes through the transform stage first, a message the script
+// drops reaches neither sink and TAK gets the message as changed by the script. The mapped
+// points of a dropped or filtered position are dropped with it, a map report whose
+// position is filtered is exported without its coordinates.
+func publishEvent(event interface{}, mapped []metrics.Point, telegrafChannel chan shared.TelegrafChannelMessage, transform shared.MessageTransform, poster *tak.Poster, identities *tak.IdentityRegistry, positionFilter *position.Filter) error {
+	changed, ok := shared.ApplyTransform(transform, event, telegrafChannel)
+	if !ok {
+		log.Debugf("%T dropped by the transform", event)
+		return nil
+	}
+	event = changed
+
+	switch v := event.(type) {
+	case parser.NodeInfoMessage:
+		identities.Learn(v.Envelope.From, v.LongName, v.ShortName)
+		for _, point := range mapped {
+			telegrafChannel <- point
+		}
+		telegrafChannel <- shared.Transformed{Message: v}
+
+	case parser.MapReportMessage:
+		identities.Learn(v.Envelope.From, v.LongName, v.ShortName)
+
+		latitude := float64(v.LatitudeI) / 10_000_000.0
+		longitude := float64(v.LongitudeI) / 10_000_000.0
+		if !positionFilter.Accept(v.Envelope.From, latitude, longitude, time.Now()) {
+			// the rest of the report is still exported, without its position
+			log.Debugf("MAP: position of [%x] filtered", v.Envelope.From)
+			v.LatitudeI, v.LongitudeI, v.Altitude = 0, 0, 0
+			telegrafChannel <- shared.Transformed{Message: v}
+			return nil
+		}
+
+		for _, point := range mapped {
+			telegrafChannel <- point
+		}
+		telegrafChannel <- shared.Transformed{Message: v}
+
+		if identities.IsBridged(v.Envelope.From) {
+			log.Debugf("[%x] is a bridged TAK user, not posted to TAK", v.Envelope.From)
+			return nil
+		}
+
+		telemetry := tak.NewTelemetry(identities.Resolve(v.Envelope.From), latitude, longitude)
+		telemetry.Fields = tak.EnvelopeFields(v.Envelope.From, v.Envelope.To, v.Envelope.Topic)
+		telemetry.Fields["position.altitude"] = v.Altitude
+
+		respBody, err := poster.Post(context.Background(), telemetry)
+		if err != nil {
+			log.Errorf("failed to post to TAK Server: %s", err)
+			return err
+		}
+		log.Infof("MAP: POST to TAK Server: %s", respBody)
+
+	case parser.PositionMessage:
+		latitude := float64(v.LatitudeI) / 10_000_000.0
+		longitude := float64(v.LongitudeI) / 10_000_000.0
+		if !positionFilter.Accept(v.Envelope.From, latitude, longitude, time.Now()) {
+			log.Debugf("POSITION: position of [%x] filtered", v.Envelope.From)
+			return nil
+		}
+
+		for _, point := range mapped {
+			telegrafChannel <- point
+		}
+		telegrafChannel <- shared.Transformed{Message: v}
+
+		if identities.IsBridged(v.Envelope.From) {
+			log.Debugf("[%x] is a bridged TAK user, not posted to TAK", v.Envelope.From)
+			return nil
+		}
+
+		telemetry := tak.NewTelemetry(identities.Resolve(v.Envelope.From), latitude, longitude)
+		telemetry.Fields = tak.EnvelopeFields(v.Envelope.From, v.Envelope.To, v.Envelope.Topic)
+		telemetry.Fields["position.altitude"] = v.Altitude
+		telemetry.Fields["position.ground_speed"] = v.GroundSpeed
+		telemetry.Fields["position.ground_track"] = v.GroundTrack
+
+		respBody, err := poster.Post(context.Background(), telemetry)
+		if err != nil {
+			log.Errorf("failed to post to TAK Server: %s", err)
+			return err
+		}
+		log.Infof("POSITION: POST to TAK Server: %s", respBody)
+
+	case parser.DeviceMetrics:
+		poster.RecordTelemetry(v.Envelope.From, map[string]interface{}{
+			"battery_level":       v.BatteryLevel,
+			"voltage":             v.Voltage,
+			"channel_utilization": v.ChannelUtilization,
+			"air_util_tx":         v.AirUtilTx,
+			"uptime_seconds":      v.UptimeSeconds,
+		})
+		for _, point := range mapped {
+			telegrafChannel <- point
+		}
+		telegrafChannel <- shared.Transformed{Message: v}
+
+	case parser.EnvironmentMetrics:
+		poster.RecordTelemetry(v.Envelope.From, map[string]interface{}{
+			"temperature":       v.Temperature,
+			"relative_humidity": v.RelativeHumidity,
+		})
+		for _, point := range mapped {
+			telegrafChannel <- point
+		}
+		telegrafChannel <- shared.Transformed{Message: v}
+
+	default:
+		log.Errorf("no sink for %T", event)
+		return shared.ErrMeshHandlerError
+	}
+	return nil
+}
+
+func init() {
+	shared.RegisterPlugin("msh", New)
+}
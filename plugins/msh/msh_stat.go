@@ -0,0 +1,43 @@
+package msh
+
+import (
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/parser"
+	"gomqttenc/shared"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const gatewayStatusMeasurement = "mesh_gateway_status"
+
+// handleGatewayStatus exports the online or offline status a gateway publishes retained to
+// <root>/<region>/2/stat/<!gateway>, offline being its last will
+func handleGatewayStatus(msg mqtt.Message, topic parser.MeshTopic, telegrafChannel chan shared.TelegrafChannelMessage) error {
+	status := strings.TrimSpace(string(msg.Payload()))
+
+	var online int64
+	switch status {
+	case "online":
+		online = 1
+	case "offline":
+	default:
+		return fmt.Errorf("%w: unknown gateway status [%q] on [%s]", shared.ErrMeshHandlerError, status, msg.Topic())
+	}
+	log.Infof("gateway [%s] is %s", topic.Gateway, status)
+
+	env := parser.MessageEnvelope{Topic: msg.Topic()}
+	env.SetMeshTopic(topic)
+
+	telegrafChannel <- metrics.Point{
+		Measurement: gatewayStatusMeasurement,
+		Tags:        env.TopicTags(),
+		Fields: map[string]interface{}{
+			"status": status,
+			"online": online,
+		},
+	}
+	return nil
+}
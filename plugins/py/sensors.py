@@ -0,0 +1,75 @@
+#!/usr/bin/env python3
+"""Example external plugin for gomqttenc.
+
+Exports JSON sensor readings published on sensors/<room> as one point per message, the
+room taken from the topic. See plugins/external for the protocol. Options:
+
+    measurement  name of the measurement, "sensor" by default
+    fields       list of the keys to export, every number, string and bool by default
+
+    "sensors/#": {"name": "py-sensors", "qos": 0,
+                  "options": {"measurement": "sensor", "fields": ["temp", "humidity"]},
+                  "external": {"command": ["python3", "./plugins/py/sensors.py"]}}
+"""
+
+import base64
+import json
+import sys
+
+options = {"measurement": "sensor", "fields": None}
+
+
+def answer(frame):
+    sys.stdout.write(json.dumps(frame) + "\n")
+    sys.stdout.flush()
+
+
+def init(frame):
+    opts = frame.get("options") or {}
+    unknown = set(opts) - set(options)
+    if unknown:
+        raise ValueError("unknown options %s" % ", ".join(sorted(unknown)))
+    options.update(opts)
+
+
+def message(frame):
+    reading = json.loads(base64.b64decode(frame["payload"]))
+    if not isinstance(reading, dict):
+        raise ValueError("payload is not a JSON object")
+
+    fields = {
+        k: v
+        for k, v in reading.items()
+        if isinstance(v, (int, float, str, bool))
+        and (options["fields"] is None or k in options["fields"])
+    }
+    if not fields:
+        return []
+
+    room = frame["topic"].rsplit("/", 1)[-1]
+    return [{"measurement": options["measurement"], "tags": {"room": room}, "fields": fields}]
+
+
+def main():
+    for line in sys.stdin:
+        if not line.strip():
+            continue
+        frame = json.loads(line)
+        kind, id = frame.get("type"), frame.get("id")
+
+        try:
+            if kind == "init":
+                init(frame)
+                answer({"type": "ready", "id": id})
+            elif kind == "message":
+                answer({"type": "result", "id": id, "events": message(frame)})
+            elif kind == "ping":
+                answer({"type": "pong", "id": id})
+            else:
+                print("unknown frame type %r" % kind, file=sys.stderr)
+        except Exception as e:
+            answer({"type": "ready" if kind == "init" else "result", "id": id, "error": str(e)})
+
+
+if __name__ == "__main__":
+    main()
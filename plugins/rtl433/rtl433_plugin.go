@@ -1,52 +1,110 @@
-package main
+package rtl433
 
 import (
+	"context"
 	"encoding/json"
 	"gomqttenc/rtl433"
 	"gomqttenc/shared"
+	"gomqttenc/tak"
+	"time"
 
 	"github.com/charmbracelet/log"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-type MshMqttHandler struct{}
+type MshMqttHandler struct {
+	services *shared.PluginServices
+}
 
-func (m MshMqttHandler) Process(name string, data interface{}, msg mqtt.Message) error {
+// New returns an instance of the plugin, also exported as NewPlugin by its .so build
+func New() shared.Plugin {
+	return &MshMqttHandler{}
+}
 
-	ctx, ok := data.(*shared.MqttMessageHandlerContext)
-	if !ok {
-		log.Error("failed to cast expected data to MqttMessageHandlerContext")
+func (m *MshMqttHandler) APIVersion() int {
+	return shared.PluginAPIVersion
+}
+
+// Init takes no options, the decoder and device registry come from the rtl433 config
+func (m *MshMqttHandler) Init(config json.RawMessage, services *shared.PluginServices) error {
+	m.services = services
+	return shared.DecodePluginOptions(config, &struct{}{})
+}
+
+func (m *MshMqttHandler) Close() error {
+	return nil
+}
+
+func (m *MshMqttHandler) Process(topic string, msg mqtt.Message) error {
+
+	ctx := m.services
+	telegrafChannel := ctx.Telegraf
+
+	point, err := ctx.RTL433.Decode(msg.Payload())
+	if err != nil {
+		log.Warnf("Error decoding rtl_433 event: payload: [%s]  %v", msg.Payload(), err)
 		return rtl433.ErrHandleRTL433Data
 	}
 
-	telegrafChannel, ok := (ctx.TelegrafChan).(chan shared.TelegrafChannelMessage)
+	now := time.Now()
+	match := ctx.RTL433Devices.Apply(point, now)
+	if match.Swap != nil {
+		telegrafChannel <- *match.Swap
+	}
+	if match.Drop {
+		log.Debugf("dropping event of unregistered device [%s] [%s]", point.Tags["model"], point.Tags["id"])
+		return nil
+	}
+
+	// the script sees the event before both sinks, a dropped event does not post the
+	// sensor position either
+	changed, ok := shared.ApplyTransform(ctx.Transform, *point, telegrafChannel)
 	if !ok {
-		log.Fatal("failed to cast expected data to chan shared.TelegrafChannelMessage")
+		log.Debugf("rtl_433 event of [%s] [%s] dropped by the transform", point.Tags["model"], point.Tags["id"])
+		return nil
 	}
+	telegrafChannel <- shared.Transformed{Message: changed}
 
-	var sd rtl433.RTL433SensorData
+	// registered sensors with a static position show up in TAK
+	if match.Device != nil && match.Device.HasPosition() {
+		return postSensorPosition(ctx, match.Device, now)
+	}
 
-	// Unmarshal the JSON into the struct
-	if err := json.Unmarshal([]byte(msg.Payload()), &sd); err != nil {
-		log.Warnf("Error unmarshaling JSON: payload: [%s]  %v", msg.Payload(), err)
-		return rtl433.ErrHandleRTL433Data
+	return nil
+}
+
+func postSensorPosition(ctx *shared.PluginServices, dev *rtl433.Device, now time.Time) error {
+	if !ctx.RTL433Devices.PositionDue(dev, now) {
+		log.Debugf("RTL433: position of sensor [%s] rate limited", dev.UID())
+		return nil
+	}
+
+	callsign := dev.Name
+	if callsign == "" {
+		callsign = dev.UID()
 	}
 
-	// publish to Telegraf
-	telegrafChannel <- rtl433.RTL433SensorData{
-		Time:         sd.Time,
-		Model:        sd.Model,
-		ID:           sd.ID,
-		BatteryOK:    sd.BatteryOK,
-		TemperatureC: sd.TemperatureC,
-		Humidity:     sd.Humidity,
-		Status:       sd.Status,
-		MIC:          sd.MIC,
+	telemetry := tak.NewTelemetry(tak.Identity{
+		Node:     dev.Node,
+		UID:      dev.UID(),
+		Callsign: callsign,
+		Team:     tak.DefaultTeam,
+		Role:     tak.DefaultRole,
+		CotType:  dev.CotType,
+		Serial:   float64(dev.Node),
+	}, dev.Latitude, dev.Longitude)
+
+	respBody, err := ctx.TAK.Post(context.Background(), telemetry)
+	if err != nil {
+		log.Errorf("failed to post rtl_433 sensor [%s] to TAK Server: %s", callsign, err)
+		return err
 	}
+	log.Infof("RTL433: POST to TAK Server: %s", respBody)
 
 	return nil
 }
 
-// This symbol will be looked up
-var Handler shared.MqttPluginHandler = MshMqttHandler{}
+func init() {
+	shared.RegisterPlugin("rtl433", New)
+}
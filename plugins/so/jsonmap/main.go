@@ -0,0 +1,16 @@
+//go:build goplugin
+
+// Package main wraps the json plugin for go build -tags goplugin -buildmode=plugin
+package main
+
+import (
+	"gomqttenc/plugins/jsonmap"
+	"gomqttenc/shared"
+)
+
+// NewPlugin is the symbol loadMqttPlugin looks up
+func NewPlugin() shared.Plugin {
+	return jsonmap.New()
+}
+
+func main() {}
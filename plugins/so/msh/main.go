@@ -0,0 +1,16 @@
+//go:build goplugin
+
+// Package main wraps the msh plugin for go build -tags goplugin -buildmode=plugin
+package main
+
+import (
+	"gomqttenc/plugins/msh"
+	"gomqttenc/shared"
+)
+
+// NewPlugin is the symbol loadMqttPlugin looks up
+func NewPlugin() shared.Plugin {
+	return msh.New()
+}
+
+func main() {}
@@ -0,0 +1,16 @@
+//go:build goplugin
+
+// Package main wraps the rtl433 plugin for go build -tags goplugin -buildmode=plugin
+package main
+
+import (
+	"gomqttenc/plugins/rtl433"
+	"gomqttenc/shared"
+)
+
+// NewPlugin is the symbol loadMqttPlugin looks up
+func NewPlugin() shared.Plugin {
+	return rtl433.New()
+}
+
+func main() {}
@@ -0,0 +1,16 @@
+//go:build goplugin
+
+// Package main wraps the udp plugin for go build -tags goplugin -buildmode=plugin
+package main
+
+import (
+	"gomqttenc/plugins/udp"
+	"gomqttenc/shared"
+)
+
+// NewPlugin is the symbol loadMqttPlugin looks up
+func NewPlugin() shared.Plugin {
+	return udp.New()
+}
+
+func main() {}
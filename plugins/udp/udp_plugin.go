@@ -1,12 +1,14 @@
-package main
+package udp
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"gomqttenc/mapping"
 	"gomqttenc/md"
 	"gomqttenc/parser"
+	"gomqttenc/position"
 	"gomqttenc/shared"
 	"gomqttenc/tak"
 	"gomqttenc/utils"
@@ -18,25 +20,45 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-type MshMqttHandler struct{}
+type MshMqttHandler struct {
+	services *shared.PluginServices
+	mapper   *mapping.Mapper
+}
 
-func (m MshMqttHandler) Process(name string, data interface{}, msg mqtt.Message) error {
+// New returns an instance of the plugin, also exported as NewPlugin by its .so build
+func New() shared.Plugin {
+	return &MshMqttHandler{}
+}
 
-	ctx, ok := data.(*shared.MqttMessageHandlerContext)
-	if !ok {
-		log.Fatal("failed to cast expected data to MqttMessageHandlerContext")
+func (m *MshMqttHandler) APIVersion() int {
+	return shared.PluginAPIVersion
+}
+
+// Init takes no options, decoded payloads are also exported following the mapping rules
+func (m *MshMqttHandler) Init(config json.RawMessage, services *shared.PluginServices) error {
+	m.services = services
+	if err := shared.DecodePluginOptions(config, &struct{}{}); err != nil {
+		return err
 	}
 
-	telegrafChan, ok := (ctx.TelegrafChan).(chan shared.TelegrafChannelMessage)
-	if !ok {
-		log.Fatal("failed to cast expected data to chan shared.TelegrafChannelMessage")
+	mapper, err := mapping.New(services.Mappings)
+	if err != nil {
+		return err
 	}
+	m.mapper = mapper
+	return nil
+}
 
-	return HandleUDPPacket(msg, telegrafChan, ctx.ChannelKeys, ctx.ChannelKeysByChannelNum, ctx.TAKServer, ctx.TAKCerts.TLSClientConfig)
+func (m *MshMqttHandler) Process(topic string, msg mqtt.Message) error {
+	s := m.services
+	return HandleUDPPacket(msg, s.Telegraf, s.Transform, s.Keys.ByName, s.Keys.ByChannelNum, s.TAK, s.Identities, s.PositionFilter, m.mapper)
+}
 
+func (m *MshMqttHandler) Close() error {
+	return nil
 }
 
-func HandleUDPPacket(msg mqtt.Message, telegrafChannel chan shared.TelegrafChannelMessage, channelKeys map[string]shared.Key, channelKeysByChannelNum map[uint32]shared.Key, TAKServer string, tlsConfig *tls.Config) error {
+func HandleUDPPacket(msg mqtt.Message, telegrafChannel chan shared.TelegrafChannelMessage, transform shared.MessageTransform, channelKeys map[string]shared.Key, channelKeysByChannelNum map[uint32]shared.Key, poster *tak.Poster, identities *tak.IdentityRegistry, positionFilter *position.Filter, mapper *mapping.Mapper) error {
 
 	var mesh meshtastic.MeshPacket
 	err := proto.Unmarshal(msg.Payload(), &mesh)
@@ -46,18 +68,23 @@ func HandleUDPPacket(msg mqtt.Message, telegrafChannel chan shared.TelegrafChann
 	}
 
 	messageEnv := parser.MessageEnvelope{
-		Device: mesh.From,
-		From:   mesh.From,
-		To:     mesh.To,
-		Topic:  msg.Topic(),
+		Device:     mesh.From,
+		From:       mesh.From,
+		To:         mesh.To,
+		Topic:      msg.Topic(),
+		Properties: shared.UserProperties(msg),
 	}
 
 	log.Warnf("From: [%x] To: [%x] Id: [%x] Channel: [%x], WantAck: [%v], ViaMqtt: [%v]",
 		mesh.From, mesh.To, mesh.Id, mesh.Channel, mesh.WantAck, mesh.ViaMqtt)
 
-	if !mesh.PkiEncrypted {
-		if mesh.GetDecoded() != nil {
-			log.Warnf("ignoring decoded payload: [%s]", mesh.GetDecoded())
+	if mesh.GetDecoded() != nil || !mesh.PkiEncrypted {
+		var messagePtr *meshtastic.Data
+
+		if decoded := mesh.GetDecoded(); decoded != nil {
+			// packets from a directly attached radio arrive already decrypted
+			log.Debugf("packet [%x] already decoded", mesh.Id)
+			messagePtr = decoded
 		} else {
 			var privKeys []shared.Key
 			log.Warnf("encrypted payload: [%s]", hex.EncodeToString(mesh.GetEncrypted()))
@@ -66,86 +93,149 @@ func HandleUDPPacket(msg mqtt.Message, telegrafChannel chan shared.TelegrafChann
 			// TODO - need to create mapping for channel num to string
 			privKey, ok := channelKeysByChannelNum[mesh.Channel]
 			if !ok {
-				log.Errorf("no private key found for Channel: [%x]", mesh.Channel)
-				return shared.ErrMeshHandlerError
+				// traffic of channels and nodes without a key is expected, not a failure
+				log.Debugf("no private key found for Channel: [%x], not decoded", mesh.Channel)
+				return nil
 			}
 			log.Debugf("Decoding with key [%s]", privKey.Txt)
 
 			privKeys = append(privKeys, privKey)
 
-			messagePtr, err := md.TryDecode(&mesh, privKeys, md.DecryptChannel)
+			messagePtr, err = md.TryDecode(&mesh, privKeys, md.DecryptChannel)
 
 			if err != nil {
 				log.Error("failed to decode packet", "err", err, "payload", hex.EncodeToString(mesh.GetEncrypted()))
-				return shared.ErrMeshHandlerError
+				return fmt.Errorf("%w: %w", shared.ErrMeshHandlerError, err)
 			}
+		}
+
+		if out, obj, err := shared.ProcessMessage(messagePtr); err != nil {
+			if messagePtr.Portnum != 0 {
+				log.Error("failed to process message", "err", err, "source", messagePtr.Source, "dest", messagePtr.Dest, "payload", hex.EncodeToString(msg.Payload()), "topic", msg.Topic(), "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
+			}
+			return shared.ErrMeshHandlerError
+		} else {
 
-			if out, obj, err := shared.ProcessMessage(messagePtr); err != nil {
-				if messagePtr.Portnum != 0 {
-					log.Error("failed to process message", "err", err, "source", messagePtr.Source, "dest", messagePtr.Dest, "payload", hex.EncodeToString(msg.Payload()), "topic", msg.Topic(), "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
+			// the points mapped from a position wait for the position filter
+			mapped := mapper.MapDecoded(mapping.Input{
+				Portnum: messagePtr.Portnum.String(),
+				Topic:   msg.Topic(),
+				Tags:    map[string]string{"device": fmt.Sprintf("%x", mesh.From)},
+			}, obj)
+			if messagePtr.Portnum != meshtastic.PortNum_POSITION_APP {
+				for _, point := range mapped {
+					telegrafChannel <- point
 				}
-				return shared.ErrMeshHandlerError
-			} else {
+				mapped = nil
+			}
+
+			switch messagePtr.Portnum {
 
-				switch messagePtr.Portnum {
+			case meshtastic.PortNum_TEXT_MESSAGE_APP:
+				log.Infof("\x1b[7m")
+				log.Info(out, "topic", msg.Topic, "source", messagePtr.Source, "dest", messagePtr.Dest, "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
+				log.Infof("\x1b[0m")
 
-				case meshtastic.PortNum_TEXT_MESSAGE_APP:
-					log.Infof("\x1b[7m")
+			case meshtastic.PortNum_POSITION_APP:
+				pos, ok := obj.(*meshtastic.Position)
+				if ok {
+					log.Infof("\x1b[33;40")
 					log.Info(out, "topic", msg.Topic, "source", messagePtr.Source, "dest", messagePtr.Dest, "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
 					log.Infof("\x1b[0m")
 
-				case meshtastic.PortNum_POSITION_APP:
-					pos, ok := obj.(*meshtastic.Position)
-					if ok {
-						log.Infof("\x1b[33;40")
-						log.Info(out, "topic", msg.Topic, "source", messagePtr.Source, "dest", messagePtr.Dest, "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
-						log.Infof("\x1b[0m")
-
-						if pos != nil && pos.LatitudeI != nil && pos.LongitudeI != nil {
-							resp, err := tak.PostTelemetryTAK(context.Background(),
-								TAKServer, tlsConfig, tak.Telemetry{
-									SerialNumber: float64(messageEnv.From),
-									DateTime:     time.Now(),
-									Latitude:     float64(*(pos.LatitudeI)) / 10_000_000.0,
-									Longitude:    float64(*(pos.LongitudeI)) / 10_000_000.0,
-									Event:        0,
-									SolarPower:   0.0,
-									Speed:        0.0,
-									Heading:      0,
-								}, true)
-							if err != nil {
-								log.Errorf("failed to post to TAK Server: %s", err)
-								return err
-							}
-							log.Infof("POSITION: POST to TAK Server: %s", resp)
-						} else {
-							log.Infof("POSITION: not posted, one ore more values is null in the POSITION object")
+					if pos != nil && pos.LatitudeI != nil && pos.LongitudeI != nil {
+						latitude := float64(*(pos.LatitudeI)) / 10_000_000.0
+						longitude := float64(*(pos.LongitudeI)) / 10_000_000.0
+						if !positionFilter.Accept(messageEnv.From, latitude, longitude, time.Now()) {
+							log.Debugf("POSITION: position of [%x] filtered", messageEnv.From)
+							return nil
 						}
-					}
 
-				default:
-					log.Info(out, "topic", msg.Topic, "source", messagePtr.Source, "dest", messagePtr.Dest, "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
+						// the script sees the position before TAK does, its mapped points are
+						// dropped with it
+						changed, ok := shared.ApplyTransform(transform, positionMessage(messageEnv, pos), telegrafChannel)
+						if !ok {
+							log.Debugf("POSITION: position of [%x] dropped by the transform", messageEnv.From)
+							return nil
+						}
+						for _, point := range mapped {
+							telegrafChannel <- point
+						}
+
+						if identities.IsBridged(messageEnv.From) {
+							log.Debugf("[%x] is a bridged TAK user, not posted to TAK", messageEnv.From)
+							return nil
+						}
+
+						posted, ok := changed.(parser.PositionMessage)
+						if !ok {
+							log.Errorf("POSITION: transform returned %T, not posted", changed)
+							return shared.ErrMeshHandlerError
+						}
+						latitude = float64(posted.LatitudeI) / 10_000_000.0
+						longitude = float64(posted.LongitudeI) / 10_000_000.0
+
+						telemetry := tak.NewTelemetry(identities.Resolve(messageEnv.From), latitude, longitude)
+						telemetry.Fields = tak.EnvelopeFields(posted.Envelope.From, posted.Envelope.To, posted.Envelope.Topic)
+						if pos.Altitude != nil {
+							telemetry.Fields["position.altitude"] = posted.Altitude
+						}
+						telemetry.Fields["position.ground_speed"] = posted.GroundSpeed
+						telemetry.Fields["position.ground_track"] = posted.GroundTrack
+
+						resp, err := poster.Post(context.Background(), telemetry)
+						if err != nil {
+							log.Errorf("failed to post to TAK Server: %s", err)
+							return err
+						}
+						log.Infof("POSITION: POST to TAK Server: %s", resp)
+					} else {
+						log.Infof("POSITION: not posted, one ore more values is null in the POSITION object")
+						for _, point := range mapped {
+							telegrafChannel <- point
+						}
+					}
 				}
 
-				log.Debugf("parsing [%s]", out)
-				messageEnv := parser.MessageEnvelope{
-					Device: mesh.From,
-					From:   mesh.From,
-					To:     mesh.To,
-					Topic:  msg.Topic(),
+			case meshtastic.PortNum_NODEINFO_APP:
+				log.Info(out, "topic", msg.Topic, "source", messagePtr.Source, "dest", messagePtr.Dest, "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
+				if user, ok := obj.(*meshtastic.User); ok && user != nil {
+					identities.Learn(mesh.From, user.LongName, user.ShortName)
 				}
-				log.Debugf("message Env: [%v]", messageEnv)
-				// TODO need to add telegraf publishing  (from msh - create shared code..)
+
+			default:
+				log.Info(out, "topic", msg.Topic, "source", messagePtr.Source, "dest", messagePtr.Dest, "channel", mesh.Channel, "portnum", messagePtr.Portnum.String())
 			}
 
+			log.Debugf("parsing [%s]", out)
+			messageEnv := parser.MessageEnvelope{
+				Device:     mesh.From,
+				From:       mesh.From,
+				To:         mesh.To,
+				Topic:      msg.Topic(),
+				Properties: shared.UserProperties(msg),
+			}
+			log.Debugf("message Env: [%v]", messageEnv)
+			// TODO need to add telegraf publishing  (from msh - create shared code..)
 		}
 	} else {
 
 		fromKeyName := fmt.Sprintf("!%x", mesh.From)
 		toKeyName := fmt.Sprintf("!%x", mesh.To)
 
+		fromKey, ok := channelKeys[fromKeyName]
+		if !ok {
+			log.Debugf("PKI: no private key found for fromAddr: [%s], not decoded", fromKeyName)
+			return nil
+		}
+		toKey, ok := channelKeys[toKeyName]
+		if !ok {
+			log.Debugf("PKI: no private key found for toAddr: [%s], not decoded", toKeyName)
+			return nil
+		}
+
 		// compute Sender' public key from private key
-		keyslice, err := utils.SliceTo32ByteArray(channelKeys[fromKeyName].Hex)
+		keyslice, err := utils.SliceTo32ByteArray(fromKey.Hex)
 		if err != nil {
 			log.Warnf("failed to SliceTo32Bytes: %s", err)
 			return shared.ErrMeshHandlerError
@@ -156,7 +246,7 @@ func HandleUDPPacket(msg mqtt.Message, telegrafChannel chan shared.TelegrafChann
 			return shared.ErrMeshHandlerError
 		}
 
-		decrypted, err := md.DecryptCurve25519(mesh.From, mesh.Id, senderPub[:], channelKeys[toKeyName].Hex, mesh.GetEncrypted())
+		decrypted, err := md.DecryptCurve25519(mesh.From, mesh.Id, senderPub[:], toKey.Hex, mesh.GetEncrypted())
 
 		if err != nil {
 			log.Warnf("failed to decrypting packet: %s", err)
@@ -182,5 +272,22 @@ func HandleUDPPacket(msg mqtt.Message, telegrafChannel chan shared.TelegrafChann
 	return nil
 }
 
-// This symbol will be looked up
-var Handler shared.MqttPluginHandler = MshMqttHandler{}
+// positionMessage is the message of a decoded position as the msh plugin parses it, the
+// form the transform stage sees positions in
+func positionMessage(env parser.MessageEnvelope, pos *meshtastic.Position) parser.PositionMessage {
+	return parser.PositionMessage{
+		Envelope:       env,
+		LatitudeI:      int(pos.GetLatitudeI()),
+		LongitudeI:     int(pos.GetLongitudeI()),
+		Altitude:       int(pos.GetAltitude()),
+		Time:           int64(pos.GetTime()),
+		LocationSource: pos.GetLocationSource().String(),
+		GroundSpeed:    int(pos.GetGroundSpeed()),
+		GroundTrack:    int(pos.GetGroundTrack()),
+		PrecisionBits:  int(pos.GetPrecisionBits()),
+	}
+}
+
+func init() {
+	shared.RegisterPlugin("udp", New)
+}
@@ -0,0 +1,102 @@
+package position
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const earthRadiusMeters = 6_371_000.0
+
+// FilterConfig is the position_filter section of the application config. Zero values
+// disable the corresponding check.
+type FilterConfig struct {
+	MinDistance float64 `json:"min_distance_m"`
+	MinInterval int     `json:"min_interval_s"`
+	MaxSilence  int     `json:"max_silence_s"`
+}
+
+// Fix is the last accepted position of a node
+type Fix struct {
+	Latitude  float64
+	Longitude float64
+	Time      time.Time
+}
+
+// Filter decides per node whether a position report is worth exporting. A report is
+// accepted when the node moved at least MinDistance meters since its last accepted fix,
+// but never more often than MinInterval. Once MaxSilence has elapsed a report is accepted
+// regardless of movement so stationary nodes keep a heartbeat.
+type Filter struct {
+	mu          sync.Mutex
+	minDistance float64
+	minInterval time.Duration
+	maxSilence  time.Duration
+	last        map[uint32]Fix
+}
+
+func NewFilter(cfg FilterConfig) *Filter {
+	return &Filter{
+		minDistance: cfg.MinDistance,
+		minInterval: time.Duration(cfg.MinInterval) * time.Second,
+		maxSilence:  time.Duration(cfg.MaxSilence) * time.Second,
+		last:        make(map[uint32]Fix),
+	}
+}
+
+// Accept reports whether the position should be exported and, if so, records it as the
+// node's last accepted fix. A nil filter accepts everything.
+func (f *Filter) Accept(node uint32, latitude, longitude float64, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fix := Fix{Latitude: latitude, Longitude: longitude, Time: now}
+
+	prev, ok := f.last[node]
+	if !ok {
+		f.last[node] = fix
+		return true
+	}
+
+	elapsed := now.Sub(prev.Time)
+	if elapsed < f.minInterval {
+		return false
+	}
+
+	if (f.maxSilence > 0 && elapsed >= f.maxSilence) ||
+		Distance(prev.Latitude, prev.Longitude, latitude, longitude) >= f.minDistance {
+		f.last[node] = fix
+		return true
+	}
+
+	return false
+}
+
+// LastFix returns the last accepted fix for a node
+func (f *Filter) LastFix(node uint32) (Fix, bool) {
+	if f == nil {
+		return Fix{}, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fix, ok := f.last[node]
+	return fix, ok
+}
+
+// Distance returns the great-circle distance in meters between two coordinates
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180.0 }
+
+	dLat := rad(lat2 - lat1)
+	dLon := rad(lon2 - lon1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusMeters * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
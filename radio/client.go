@@ -0,0 +1,150 @@
+package radio
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/rabarar/meshtastic"
+)
+
+const heartbeatInterval = 5 * time.Minute
+
+// Handlers receive what the radio sends over its streaming API. Nil handlers are skipped.
+type Handlers struct {
+	Packet   func(*meshtastic.MeshPacket)
+	NodeInfo func(*meshtastic.NodeInfo)
+}
+
+// Session speaks the streaming protocol over an already opened connection to a radio
+type Session struct {
+	name      string
+	conn      io.ReadWriteCloser
+	handlers  Handlers
+	heartbeat time.Duration
+
+	writeMu sync.Mutex
+}
+
+func NewSession(name string, conn io.ReadWriteCloser, handlers Handlers) *Session {
+	return &Session{
+		name:      name,
+		conn:      conn,
+		handlers:  handlers,
+		heartbeat: heartbeatInterval,
+	}
+}
+
+// Run requests the config and node DB and then dispatches FromRadio messages until the
+// connection fails or ctx is cancelled. The connection is closed when Run returns.
+func (s *Session) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(s.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				s.disconnect()
+				return
+			case <-ticker.C:
+				if err := s.send(&meshtastic.ToRadio{
+					PayloadVariant: &meshtastic.ToRadio_Heartbeat{Heartbeat: &meshtastic.Heartbeat{}},
+				}); err != nil {
+					log.Warnf("radio [%s]: heartbeat failed: %s", s.name, err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		if err := s.conn.Close(); err != nil {
+			log.Debugf("radio [%s]: close: %s", s.name, err)
+		}
+	}()
+
+	configID := nonce()
+	if err := s.send(&meshtastic.ToRadio{
+		PayloadVariant: &meshtastic.ToRadio_WantConfigId{WantConfigId: configID},
+	}); err != nil {
+		return err
+	}
+
+	var console []byte
+	reader := bufio.NewReader(s.conn)
+	for {
+		msg, err := ReadFromRadio(reader, func(b byte) {
+			if b == '\n' {
+				log.Debugf("radio [%s] console: %s", s.name, console)
+				console = console[:0]
+				return
+			}
+			console = append(console, b)
+		})
+		if errors.Is(err, ErrBadFrame) {
+			log.Warnf("radio [%s]: dropping frame: %s", s.name, err)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		switch v := msg.GetPayloadVariant().(type) {
+		case *meshtastic.FromRadio_Packet:
+			if s.handlers.Packet != nil && v.Packet != nil {
+				s.handlers.Packet(v.Packet)
+			}
+		case *meshtastic.FromRadio_NodeInfo:
+			if s.handlers.NodeInfo != nil && v.NodeInfo != nil {
+				s.handlers.NodeInfo(v.NodeInfo)
+			}
+		case *meshtastic.FromRadio_MyInfo:
+			log.Infof("radio [%s]: local node [!%08x]", s.name, v.MyInfo.GetMyNodeNum())
+		case *meshtastic.FromRadio_ConfigCompleteId:
+			if v.ConfigCompleteId == configID {
+				log.Infof("radio [%s]: config and node DB received", s.name)
+			}
+		case *meshtastic.FromRadio_Rebooted:
+			log.Warnf("radio [%s]: radio rebooted", s.name)
+			return io.EOF
+		default:
+			log.Debugf("radio [%s]: ignoring %T", s.name, v)
+		}
+	}
+}
+
+func (s *Session) send(msg *meshtastic.ToRadio) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return WriteToRadio(s.conn, msg)
+}
+
+// disconnect tells the radio we are going away and unblocks the reader
+func (s *Session) disconnect() {
+	_ = s.send(&meshtastic.ToRadio{
+		PayloadVariant: &meshtastic.ToRadio_Disconnect{Disconnect: true},
+	})
+	if err := s.conn.Close(); err != nil {
+		log.Debugf("radio [%s]: close: %s", s.name, err)
+	}
+}
+
+func nonce() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
@@ -0,0 +1,156 @@
+package radio
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+// readToRadio reads the next ToRadio frame the way the firmware does, skipping anything
+// before the start bytes such as the wake up sequence
+func readToRadio(r *bufio.Reader) (*meshtastic.ToRadio, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != Start1 {
+			continue
+		}
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		if b != Start2 {
+			continue
+		}
+
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+
+		var msg meshtastic.ToRadio
+		if err := proto.Unmarshal(payload, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+}
+
+func writeFromRadio(w io.Writer, msgs ...*meshtastic.FromRadio) error {
+	for _, msg := range msgs {
+		payload, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(rawFrame(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveRadio plays a radio that answers the config request with its node DB and a packet,
+// waits for a heartbeat and then reboots
+func serveRadio(conn net.Conn) error {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+
+	msg, err := readToRadio(r)
+	if err != nil {
+		return err
+	}
+	configID := msg.GetWantConfigId()
+	if configID == 0 {
+		return fmt.Errorf("first message %v, want want_config_id", msg)
+	}
+
+	err = writeFromRadio(conn,
+		&meshtastic.FromRadio{PayloadVariant: &meshtastic.FromRadio_MyInfo{MyInfo: &meshtastic.MyNodeInfo{MyNodeNum: 1}}},
+		&meshtastic.FromRadio{PayloadVariant: &meshtastic.FromRadio_NodeInfo{NodeInfo: &meshtastic.NodeInfo{
+			Num:  2,
+			User: &meshtastic.User{LongName: "second", ShortName: "2nd"},
+		}}},
+		&meshtastic.FromRadio{PayloadVariant: &meshtastic.FromRadio_ConfigCompleteId{ConfigCompleteId: configID}},
+		&meshtastic.FromRadio{PayloadVariant: &meshtastic.FromRadio_Packet{Packet: &meshtastic.MeshPacket{From: 2, Id: 10}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := readToRadio(r)
+		if err != nil {
+			return fmt.Errorf("waiting for heartbeat: %w", err)
+		}
+		if msg.GetHeartbeat() != nil {
+			break
+		}
+	}
+
+	return writeFromRadio(conn, &meshtastic.FromRadio{PayloadVariant: &meshtastic.FromRadio_Rebooted{Rebooted: true}})
+}
+
+// TestSessionTCP runs a session against a fake radio on a loopback TCP API
+func TestSessionTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	radioDone := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			radioDone <- err
+			return
+		}
+		radioDone <- serveRadio(conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialTCP(ctx, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []*meshtastic.MeshPacket
+	var nodes []*meshtastic.NodeInfo
+	s := NewSession("test", conn, Handlers{
+		Packet:   func(p *meshtastic.MeshPacket) { packets = append(packets, p) },
+		NodeInfo: func(n *meshtastic.NodeInfo) { nodes = append(nodes, n) },
+	})
+	s.heartbeat = 10 * time.Millisecond
+
+	if err := s.Run(ctx); !errors.Is(err, io.EOF) {
+		t.Errorf("Run: got %v, want io.EOF on reboot", err)
+	}
+	if err := <-radioDone; err != nil {
+		t.Fatalf("fake radio: %s", err)
+	}
+
+	if len(nodes) != 1 || nodes[0].GetNum() != 2 || nodes[0].GetUser().GetLongName() != "second" {
+		t.Errorf("node infos %v, want node 2", nodes)
+	}
+	if len(packets) != 1 || packets[0].GetFrom() != 2 || packets[0].GetId() != 10 {
+		t.Errorf("packets %v, want packet 10 from node 2", packets)
+	}
+}
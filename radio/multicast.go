@@ -0,0 +1,107 @@
+package radio
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	DefaultMulticastAddress = "224.0.0.69:4403"
+
+	// radios on the same LAN repeat each other's packets, ignore repeats for this long
+	multicastDedupWindow = 10 * time.Minute
+)
+
+type packetKey struct {
+	from uint32
+	id   uint32
+}
+
+// ListenMulticast joins the Meshtastic UDP multicast group and calls fn with every raw
+// MeshPacket received, once per packet id, until ctx is cancelled or the socket fails.
+// An empty interface name lets the system choose.
+func ListenMulticast(ctx context.Context, address, ifaceName string, fn func(payload []byte, packet *meshtastic.MeshPacket)) error {
+	if address == "" {
+		address = DefaultMulticastAddress
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return fmt.Errorf("resolve multicast group [%s]: %w", address, err)
+	}
+
+	var iface *net.Interface
+	if ifaceName != "" {
+		iface, err = net.InterfaceByName(ifaceName)
+		if err != nil {
+			return fmt.Errorf("multicast interface [%s]: %w", ifaceName, err)
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return fmt.Errorf("join multicast group [%s]: %w", address, err)
+	}
+
+	var once sync.Once
+	closeConn := func() {
+		once.Do(func() {
+			if err := conn.Close(); err != nil {
+				log.Debugf("multicast [%s]: close: %s", address, err)
+			}
+		})
+	}
+	defer closeConn()
+	go func() {
+		<-ctx.Done()
+		closeConn()
+	}()
+
+	seen := make(map[packetKey]time.Time)
+	lastPrune := time.Now()
+	buf := make([]byte, 2*MaxPacketSize)
+
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+
+		var packet meshtastic.MeshPacket
+		if err := proto.Unmarshal(payload, &packet); err != nil {
+			log.Debugf("multicast [%s]: ignoring non MeshPacket datagram from [%s]: %s", address, src, err)
+			continue
+		}
+
+		now := time.Now()
+		key := packetKey{from: packet.From, id: packet.Id}
+		if last, ok := seen[key]; ok && now.Sub(last) < multicastDedupWindow {
+			continue
+		}
+		seen[key] = now
+
+		if now.Sub(lastPrune) > multicastDedupWindow {
+			for k, t := range seen {
+				if now.Sub(t) >= multicastDedupWindow {
+					delete(seen, k)
+				}
+			}
+			lastPrune = now
+		}
+
+		fn(payload, &packet)
+	}
+}
@@ -0,0 +1,116 @@
+package radio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// TestListenMulticastDedup sends packets to the group over the host's multicast loopback
+// and checks that repeats of a packet are delivered once
+func TestListenMulticastDedup(t *testing.T) {
+	address := fmt.Sprintf("224.0.0.69:%d", freeUDPPort(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan *meshtastic.MeshPacket, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenMulticast(ctx, address, "", func(_ []byte, packet *meshtastic.MeshPacket) {
+			received <- packet
+		})
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("ListenMulticast: %s", err)
+		}
+	}()
+
+	group, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		t.Skipf("no multicast route: %s", err)
+	}
+	defer conn.Close()
+
+	send := func(from, id uint32) {
+		t.Helper()
+		payload, err := proto.Marshal(&meshtastic.MeshPacket{From: from, Id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(payload); err != nil {
+			t.Skipf("multicast send failed: %s", err)
+		}
+	}
+
+	// repeat the first packet until the listener has joined the group, the repeats
+	// are already duplicates
+	first := time.After(2 * time.Second)
+	var got []*meshtastic.MeshPacket
+	for len(got) == 0 {
+		send(1, 100)
+		select {
+		case p := <-received:
+			got = append(got, p)
+		case <-time.After(50 * time.Millisecond):
+		case <-first:
+			t.Skip("multicast loopback not available")
+		}
+	}
+
+	send(1, 100)
+	send(1, 101)
+	send(1, 101)
+	send(2, 100)
+	send(1, 100)
+	send(2, 100)
+	_, _ = conn.Write([]byte{0x0a, 0x05})
+	send(3, 1)
+
+	timeout := time.After(2 * time.Second)
+	for len(got) == 0 || got[len(got)-1].GetFrom() != 3 {
+		select {
+		case p := <-received:
+			got = append(got, p)
+		case <-timeout:
+			t.Fatalf("got %d packets, last packet not received", len(got))
+		}
+	}
+
+	// drain what a late repeat of the first packet may still deliver
+	select {
+	case p := <-received:
+		got = append(got, p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	want := []struct{ from, id uint32 }{{1, 100}, {1, 101}, {2, 100}, {3, 1}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].GetFrom() != w.from || got[i].GetId() != w.id {
+			t.Errorf("packet %d: from %d id %d, want from %d id %d", i, got[i].GetFrom(), got[i].GetId(), w.from, w.id)
+		}
+	}
+}
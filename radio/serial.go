@@ -0,0 +1,59 @@
+package radio
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	DefaultBaudRate = 115200
+
+	// number of START2 bytes sent to wake a sleeping radio before the first frame
+	wakeBytes = 32
+)
+
+// openPort opens the serial device, replaced by tests with a fake radio
+var openPort = func(device string, mode *serial.Mode) (io.ReadWriteCloser, error) {
+	return serial.Open(device, mode)
+}
+
+// OpenSerial opens a USB CDC attached radio and wakes it so it starts answering on the
+// streaming API
+func OpenSerial(device string, baud int) (io.ReadWriteCloser, error) {
+	if baud == 0 {
+		baud = DefaultBaudRate
+	}
+
+	port, err := openPort(device, &serial.Mode{
+		BaudRate: baud,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open serial port [%s]: %w", device, err)
+	}
+
+	if err := Wake(port); err != nil {
+		_ = port.Close()
+		return nil, fmt.Errorf("wake radio on [%s]: %w", device, err)
+	}
+	return port, nil
+}
+
+// Wake sends a run of START2 bytes, which the firmware treats as a wake up sequence, and
+// gives the radio a moment to settle
+func Wake(w io.Writer) error {
+	wake := make([]byte, wakeBytes)
+	for i := range wake {
+		wake[i] = Start2
+	}
+	if _, err := w.Write(wake); err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
@@ -0,0 +1,123 @@
+package radio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabarar/meshtastic"
+	"go.bug.st/serial"
+)
+
+// fakeSerial replaces the serial device with one end of a pipe for the duration of a test
+// and returns the radio end of it
+func fakeSerial(t *testing.T, device string) net.Conn {
+	t.Helper()
+	host, radio := net.Pipe()
+
+	orig := openPort
+	openPort = func(name string, mode *serial.Mode) (io.ReadWriteCloser, error) {
+		if name != device {
+			return nil, fmt.Errorf("no such device [%s]", name)
+		}
+		if mode.BaudRate != DefaultBaudRate {
+			return nil, fmt.Errorf("baud rate %d, want %d", mode.BaudRate, DefaultBaudRate)
+		}
+		return host, nil
+	}
+	t.Cleanup(func() {
+		openPort = orig
+		_ = radio.Close()
+	})
+	return radio
+}
+
+// serveSerialRadio checks the wake up sequence and the config request, then sends packets
+// mixed with console output and broken frames and unplugs
+func serveSerialRadio(conn net.Conn, stream []byte) error {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+
+	wake := make([]byte, wakeBytes)
+	if _, err := io.ReadFull(r, wake); err != nil {
+		return err
+	}
+	if !bytes.Equal(wake, bytes.Repeat([]byte{Start2}, wakeBytes)) {
+		return fmt.Errorf("wake sequence % x", wake)
+	}
+
+	msg, err := readToRadio(r)
+	if err != nil {
+		return err
+	}
+	if msg.GetWantConfigId() == 0 {
+		return fmt.Errorf("first message %v, want want_config_id", msg)
+	}
+
+	_, err = conn.Write(stream)
+	return err
+}
+
+func TestSerialSession(t *testing.T) {
+	radio := fakeSerial(t, "/dev/ttyFAKE0")
+
+	stream := bytes.Join([][]byte{
+		[]byte("INFO | booting\n"),
+		{Start1, 'x'},
+		packetFrame(t, 1),
+		{Start1, Start2, 0xff, 0xff},
+		rawFrame([]byte{0x0a, 0x05, 0x01}),
+		[]byte("DEBUG | radio ready\n"),
+		packetFrame(t, 2),
+	}, nil)
+
+	radioDone := make(chan error, 1)
+	go func() { radioDone <- serveSerialRadio(radio, stream) }()
+
+	port, err := OpenSerial("/dev/ttyFAKE0", 0)
+	if err != nil {
+		t.Fatalf("OpenSerial: %s", err)
+	}
+
+	var ids []uint32
+	s := NewSession("serial", port, Handlers{
+		Packet: func(p *meshtastic.MeshPacket) { ids = append(ids, p.GetId()) },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the radio going away ends the session with an error for the caller to reconnect on
+	err = s.Run(ctx)
+	if err == nil || ctx.Err() != nil {
+		t.Errorf("Run: got %v, want the read error of the unplugged radio", err)
+	}
+	if err := <-radioDone; err != nil {
+		t.Fatalf("fake radio: %s", err)
+	}
+
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("packet ids %v, want [1 2]", ids)
+	}
+}
+
+func TestOpenSerialMissingDevice(t *testing.T) {
+	fakeSerial(t, "/dev/ttyFAKE0")
+
+	_, err := OpenSerial("/dev/ttyFAKE1", 0)
+	if err == nil {
+		t.Fatal("OpenSerial of a missing device succeeded")
+	}
+	if !strings.Contains(err.Error(), "/dev/ttyFAKE1") {
+		t.Errorf("error %q does not name the device", err)
+	}
+}
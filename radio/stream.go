@@ -0,0 +1,101 @@
+package radio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+// Framing of the Meshtastic streaming API shared by the TCP and serial interfaces: every
+// protobuf is preceded by START1 START2 and a big-endian 16 bit length.
+const (
+	Start1        = 0x94
+	Start2        = 0xc3
+	MaxPacketSize = 512
+	DefaultPort   = 4403
+)
+
+var (
+	ErrPacketTooLarge = errors.New("radio packet exceeds maximum size")
+	ErrBadFrame       = errors.New("bad radio frame")
+)
+
+// WriteToRadio frames and writes a ToRadio message
+func WriteToRadio(w io.Writer, msg *meshtastic.ToRadio) error {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal ToRadio: %w", err)
+	}
+	if len(payload) > MaxPacketSize {
+		return ErrPacketTooLarge
+	}
+
+	frame := make([]byte, 4+len(payload))
+	frame[0] = Start1
+	frame[1] = Start2
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+	copy(frame[4:], payload)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFromRadio reads the next FromRadio frame. Bytes outside of a frame are the radio's
+// debug console output and are returned through the debug callback, which may be nil.
+// A frame that does not decode returns ErrBadFrame without consuming its payload, the next
+// call resyncs on the start bytes following its header. r must buffer at least
+// MaxPacketSize bytes, as bufio.NewReader does.
+func ReadFromRadio(r *bufio.Reader, debug func(byte)) (*meshtastic.FromRadio, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != Start1 {
+			if debug != nil {
+				debug(b)
+			}
+			continue
+		}
+
+		b, err = r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != Start2 {
+			if err := r.UnreadByte(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[:]))
+		if length > MaxPacketSize {
+			// corrupt header, resync on the next start byte
+			continue
+		}
+
+		payload, err := r.Peek(length)
+		if err != nil {
+			return nil, err
+		}
+
+		var msg meshtastic.FromRadio
+		if err := proto.Unmarshal(payload, &msg); err != nil {
+			return nil, fmt.Errorf("%w: unmarshal FromRadio: %w", ErrBadFrame, err)
+		}
+		if _, err := r.Discard(length); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+}
@@ -0,0 +1,172 @@
+package radio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+func frame(t *testing.T, msg *meshtastic.FromRadio) []byte {
+	t.Helper()
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawFrame(payload)
+}
+
+func rawFrame(payload []byte) []byte {
+	header := []byte{Start1, Start2, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func packetFrame(t *testing.T, id uint32) []byte {
+	return frame(t, &meshtastic.FromRadio{
+		PayloadVariant: &meshtastic.FromRadio_Packet{Packet: &meshtastic.MeshPacket{Id: id}},
+	})
+}
+
+// readAll reads frames until EOF and returns the packet ids, ErrBadFrame counts and the
+// debug output, which includes the payload of dropped frames
+func readAll(t *testing.T, stream []byte) ([]uint32, int, string) {
+	t.Helper()
+	var ids []uint32
+	var bad int
+	var debug []byte
+
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for {
+		msg, err := ReadFromRadio(r, func(b byte) { debug = append(debug, b) })
+		switch {
+		case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			return ids, bad, string(debug)
+		case errors.Is(err, ErrBadFrame):
+			bad++
+		case err != nil:
+			t.Fatalf("ReadFromRadio: %s", err)
+		default:
+			ids = append(ids, msg.GetPacket().GetId())
+		}
+	}
+}
+
+func TestWriteToRadioFraming(t *testing.T) {
+	var buf bytes.Buffer
+	msg := &meshtastic.ToRadio{PayloadVariant: &meshtastic.ToRadio_WantConfigId{WantConfigId: 42}}
+	if err := WriteToRadio(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if b[0] != Start1 || b[1] != Start2 {
+		t.Fatalf("start bytes % x", b[:2])
+	}
+	if n := int(binary.BigEndian.Uint16(b[2:4])); n != len(b)-4 {
+		t.Fatalf("length %d, payload %d bytes", n, len(b)-4)
+	}
+
+	var got meshtastic.ToRadio
+	if err := proto.Unmarshal(b[4:], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetWantConfigId() != 42 {
+		t.Fatalf("want_config_id %d", got.GetWantConfigId())
+	}
+}
+
+func TestWriteToRadioTooLarge(t *testing.T) {
+	msg := &meshtastic.ToRadio{PayloadVariant: &meshtastic.ToRadio_Packet{Packet: &meshtastic.MeshPacket{
+		PayloadVariant: &meshtastic.MeshPacket_Encrypted{Encrypted: make([]byte, MaxPacketSize)},
+	}}}
+	if err := WriteToRadio(io.Discard, msg); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("got %v, want ErrPacketTooLarge", err)
+	}
+}
+
+func TestReadFromRadio(t *testing.T) {
+	// a length prefixed field cut short does not unmarshal
+	undecodable := rawFrame([]byte{0x0a, 0x05, 0x01})
+
+	tests := []struct {
+		name   string
+		stream [][]byte
+		ids    []uint32
+		bad    int
+		debug  string
+	}{
+		{
+			name:   "consecutive frames",
+			stream: [][]byte{packetFrame(t, 1), packetFrame(t, 2), packetFrame(t, 3)},
+			ids:    []uint32{1, 2, 3},
+		},
+		{
+			name:   "console output between frames",
+			stream: [][]byte{[]byte("boot\n"), packetFrame(t, 1), []byte("INFO x\n"), packetFrame(t, 2)},
+			ids:    []uint32{1, 2},
+			debug:  "boot\nINFO x\n",
+		},
+		{
+			name:   "lone start byte",
+			stream: [][]byte{{Start1, 'a'}, packetFrame(t, 1)},
+			ids:    []uint32{1},
+			debug:  "a",
+		},
+		{
+			name:   "repeated start byte",
+			stream: [][]byte{{Start1}, packetFrame(t, 1)},
+			ids:    []uint32{1},
+		},
+		{
+			name:   "oversized length",
+			stream: [][]byte{{Start1, Start2, 0xff, 0xff}, packetFrame(t, 1)},
+			ids:    []uint32{1},
+		},
+		{
+			name:   "undecodable frame",
+			stream: [][]byte{packetFrame(t, 1), undecodable, packetFrame(t, 2)},
+			ids:    []uint32{1, 2},
+			bad:    1,
+			debug:  "\x0a\x05\x01",
+		},
+		{
+			// the bad header claims the next frame as its payload, the resync still finds it
+			name:   "bad length covering the next frame",
+			stream: [][]byte{{Start1, Start2, 0x00, byte(len(packetFrame(t, 2)))}, {0x0a, 0x7f}, packetFrame(t, 2)},
+			ids:    []uint32{2},
+			bad:    1,
+			debug:  "\x0a\x7f",
+		},
+		{
+			name:   "truncated frame",
+			stream: [][]byte{packetFrame(t, 1), packetFrame(t, 2)[:5]},
+			ids:    []uint32{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, bad, debug := readAll(t, bytes.Join(tt.stream, nil))
+			if len(ids) != len(tt.ids) {
+				t.Fatalf("ids %v, want %v", ids, tt.ids)
+			}
+			for i := range ids {
+				if ids[i] != tt.ids[i] {
+					t.Fatalf("ids %v, want %v", ids, tt.ids)
+				}
+			}
+			if bad != tt.bad {
+				t.Errorf("%d bad frames, want %d", bad, tt.bad)
+			}
+			if debug != tt.debug {
+				t.Errorf("debug %q, want %q", debug, tt.debug)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package radio
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DialTCP connects to the TCP API of a network attached radio. The default port is used
+// when the address has none.
+func DialTCP(ctx context.Context, address string) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(DefaultPort))
+	}
+
+	dialer := &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}
+	return dialer.DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,202 @@
+package rtl433
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gomqttenc/metrics"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const DefaultMeasurement = "rtl_433"
+
+// default tag keys, every other scalar key becomes a field
+var defaultTags = []string{"model", "id", "channel"}
+
+// ModelOverride adjusts how events of one rtl_433 model are exported
+type ModelOverride struct {
+	Measurement string   `json:"measurement"`
+	Tags        []string `json:"tags"`
+	Fields      []string `json:"fields"`
+	Ignore      []string `json:"ignore"`
+}
+
+// Config is the rtl433 section of the application config. TimeZone is the IANA zone of
+// event times without an offset, the zone rtl_433 runs in, UTC by default.
+type Config struct {
+	Measurement string                   `json:"measurement"`
+	TimeZone    string                   `json:"time_zone"`
+	Models      map[string]ModelOverride `json:"models"`
+	Registry    RegistryConfig           `json:"registry"`
+}
+
+// unit conversions applied by key suffix, the value is converted and the suffix replaced
+type unitConversion struct {
+	suffix  string
+	target  string
+	convert func(float64) float64
+}
+
+var unitConversions = []unitConversion{
+	{"_F", "_C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	{"_kPa", "_hPa", func(v float64) float64 { return v * 10 }},
+	{"_psi", "_hPa", func(v float64) float64 { return v * 68.9475729 }},
+	{"_bar", "_hPa", func(v float64) float64 { return v * 1000 }},
+	{"_inHg", "_hPa", func(v float64) float64 { return v * 33.8638866 }},
+	{"_in_h", "_mm_h", func(v float64) float64 { return v * 25.4 }},
+	{"_in", "_mm", func(v float64) float64 { return v * 25.4 }},
+	{"_mi_h", "_m_s", func(v float64) float64 { return v * 0.44704 }},
+	{"_mph", "_m_s", func(v float64) float64 { return v * 0.44704 }},
+	{"_km_h", "_m_s", func(v float64) float64 { return v / 3.6 }},
+	{"_kph", "_m_s", func(v float64) float64 { return v / 3.6 }},
+}
+
+// rtl_433 time formats, depending on its -M time option
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999",
+	"2006-01-02T15:04:05.999999",
+	time.RFC3339Nano,
+}
+
+// Decoder turns rtl_433 JSON events into generic points. Every scalar key of an event is
+// kept, including the signal level keys (rssi, snr, noise, freq) added by -M level.
+type Decoder struct {
+	measurement string
+	location    *time.Location
+	models      map[string]ModelOverride
+}
+
+func NewDecoder(cfg Config) (*Decoder, error) {
+	d := &Decoder{
+		measurement: cfg.Measurement,
+		location:    time.UTC,
+		models:      cfg.Models,
+	}
+	if d.measurement == "" {
+		d.measurement = DefaultMeasurement
+	}
+	if cfg.TimeZone != "" {
+		loc, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("rtl433 time_zone: %w", err)
+		}
+		d.location = loc
+	}
+	return d, nil
+}
+
+// Decode parses one rtl_433 JSON event
+func (d *Decoder) Decode(payload []byte) (*metrics.Point, error) {
+	var event map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&event); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHandleRTL433Data, err)
+	}
+
+	model, _ := event["model"].(string)
+	if model == "" {
+		return nil, fmt.Errorf("%w: event without model", ErrHandleRTL433Data)
+	}
+
+	override := d.models[model]
+	tagKeys := toSet(defaultTags, override.Tags)
+	for _, k := range override.Fields {
+		delete(tagKeys, k)
+	}
+	ignore := toSet(override.Ignore)
+
+	point := &metrics.Point{
+		Measurement: d.measurement,
+		Tags:        make(map[string]string),
+		Fields:      make(map[string]interface{}),
+	}
+	if override.Measurement != "" {
+		point.Measurement = override.Measurement
+	}
+
+	for k, v := range event {
+		if ignore[k] {
+			continue
+		}
+		if k == "time" {
+			point.Time = parseTime(v, d.location)
+			continue
+		}
+
+		if tagKeys[k] {
+			point.Tags[k] = fmt.Sprint(v)
+			continue
+		}
+
+		switch val := v.(type) {
+		case json.Number:
+			f, err := val.Float64()
+			if err != nil {
+				continue
+			}
+			key, f := normalizeUnit(k, f)
+			if key != k {
+				// a value already in the target unit wins over a converted one
+				if _, native := event[key]; native {
+					continue
+				}
+				if _, dup := point.Fields[key]; dup {
+					log.Warnf("rtl_433: [%s] event has several keys for [%s], [%s] dropped", model, key, k)
+					continue
+				}
+			}
+			point.Fields[key] = f
+		case string:
+			point.Fields[k] = val
+		case bool:
+			point.Fields[k] = val
+		default:
+			// nested objects and arrays (e.g. raw rows) are not exported
+		}
+	}
+
+	if len(point.Fields) == 0 {
+		return nil, fmt.Errorf("%w: [%s] event without fields", ErrHandleRTL433Data, model)
+	}
+	return point, nil
+}
+
+func normalizeUnit(key string, value float64) (string, float64) {
+	for _, c := range unitConversions {
+		if strings.HasSuffix(key, c.suffix) {
+			return strings.TrimSuffix(key, c.suffix) + c.target, c.convert(value)
+		}
+	}
+	return key, value
+}
+
+func parseTime(v interface{}, loc *time.Location) time.Time {
+	switch t := v.(type) {
+	case json.Number:
+		// -M time:unix
+		if f, err := t.Float64(); err == nil {
+			return time.Unix(0, int64(f*float64(time.Second)))
+		}
+	case string:
+		for _, layout := range timeLayouts {
+			if ts, err := time.ParseInLocation(layout, t, loc); err == nil {
+				return ts
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func toSet(lists ...[]string) map[string]bool {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, k := range list {
+			set[k] = true
+		}
+	}
+	return set
+}
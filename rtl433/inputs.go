@@ -0,0 +1,146 @@
+package rtl433
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultSyslogAddress = ":1514"
+
+	maxEventSize = 64 * 1024
+)
+
+// StreamHTTP reads events from the rtl_433 HTTP API. Both the line delimited /stream
+// endpoint and the server-sent /events endpoint are understood.
+func StreamHTTP(ctx context.Context, url string, fn func([]byte)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+
+	// no client timeout, the stream is expected to stay open
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Debugf("rtl_433 stream [%s]: close: %s", url, err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rtl_433 stream [%s]: %s", url, resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 4096), maxEventSize)
+	for scanner.Scan() {
+		line := bytes.TrimPrefix(scanner.Bytes(), []byte("data:"))
+		emit(line, fn)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("rtl_433 stream [%s] closed", url)
+}
+
+// StreamWebSocket reads events from the rtl_433 WebSocket API (/ws)
+func StreamWebSocket(ctx context.Context, url string, fn func([]byte)) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+
+	var once sync.Once
+	closeConn := func() {
+		once.Do(func() {
+			if err := conn.Close(); err != nil {
+				log.Debugf("rtl_433 websocket [%s]: close: %s", url, err)
+			}
+		})
+	}
+	defer closeConn()
+	go func() {
+		<-ctx.Done()
+		closeConn()
+	}()
+
+	conn.SetReadLimit(maxEventSize)
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		emit(msg, fn)
+	}
+}
+
+// ListenSyslog receives events sent by rtl_433 -F syslog:<host>:<port>. Each datagram is
+// an RFC 5424 message whose MSG part is the JSON event.
+func ListenSyslog(ctx context.Context, address string, fn func([]byte)) error {
+	if address == "" {
+		address = DefaultSyslogAddress
+	}
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+
+	var once sync.Once
+	closeConn := func() {
+		once.Do(func() {
+			if err := conn.Close(); err != nil {
+				log.Debugf("rtl_433 syslog [%s]: close: %s", address, err)
+			}
+		})
+	}
+	defer closeConn()
+	go func() {
+		<-ctx.Done()
+		closeConn()
+	}()
+
+	buf := make([]byte, maxEventSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		start := bytes.IndexByte(buf[:n], '{')
+		if start < 0 {
+			log.Debugf("rtl_433 syslog [%s]: no JSON in [%s]", address, buf[:n])
+			continue
+		}
+		emit(buf[start:n], fn)
+	}
+}
+
+// emit passes a copy of a JSON object to fn and drops everything else (keep-alives,
+// blank lines, SSE comments)
+func emit(data []byte, fn func([]byte)) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return
+	}
+	event := make([]byte, len(data))
+	copy(event, data)
+	fn(event)
+}
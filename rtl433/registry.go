@@ -0,0 +1,248 @@
+package rtl433
+
+import (
+	"fmt"
+	"gomqttenc/metrics"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	DefaultSwapWindow       = 3600
+	DefaultPositionInterval = 600
+	DefaultSensorCotType    = "a-f-G-E-S"
+
+	swapMeasurement = "rtl_433_swap"
+
+	// unregistered devices not heard for unknownTTL are forgotten, at most maxUnknown are kept
+	unknownTTL = 24 * time.Hour
+	maxUnknown = 1024
+)
+
+// DeviceConfig registers one rtl_433 device. An empty Channel matches any channel.
+type DeviceConfig struct {
+	Model     string            `json:"model"`
+	ID        string            `json:"id"`
+	Channel   string            `json:"channel"`
+	Name      string            `json:"name"`
+	Location  string            `json:"location"`
+	Tags      map[string]string `json:"tags"`
+	Latitude  float64           `json:"latitude"`
+	Longitude float64           `json:"longitude"`
+	CotType   string            `json:"cot_type"`
+}
+
+// RegistryConfig is the registry part of the rtl433 config. SwapWindow is how long, in
+// seconds, a registered device has to be silent before an unknown id of the same model
+// and channel is flagged as a possible battery swap. The static position of a device is
+// posted to TAK at most once every PositionInterval seconds.
+type RegistryConfig struct {
+	Devices          []DeviceConfig `json:"devices"`
+	DropUnknown      bool           `json:"drop_unknown"`
+	SwapWindow       int            `json:"swap_window_s"`
+	PositionInterval int            `json:"position_interval_s"`
+}
+
+// Device is a registered device and when it was last heard. Node is a stable number
+// derived from its UID, used to key the device like a mesh node.
+type Device struct {
+	DeviceConfig
+	Node       uint32
+	lastSeen   time.Time
+	lastPosted time.Time
+}
+
+// HasPosition reports whether the device has a static position to show in TAK
+func (d *Device) HasPosition() bool {
+	return d.Latitude != 0 || d.Longitude != 0
+}
+
+// UID is the TAK UID of a positioned device
+func (d *Device) UID() string {
+	return fmt.Sprintf("RTL433-%s-%s", d.Model, d.ID)
+}
+
+// Match is the outcome of looking up an event in the registry
+type Match struct {
+	Device *Device
+	Drop   bool
+	Swap   *metrics.Point
+}
+
+type deviceKey struct {
+	model   string
+	id      string
+	channel string
+}
+
+// unknownDevice is an unregistered device, swap detection runs on each of its events
+// until it is flagged
+type unknownDevice struct {
+	lastSeen time.Time
+	flagged  bool
+}
+
+// Registry assigns names, locations and tags to known rtl_433 devices
+type Registry struct {
+	mu               sync.Mutex
+	devices          map[deviceKey]*Device
+	dropUnknown      bool
+	swapWindow       time.Duration
+	positionInterval time.Duration
+	unknown          map[deviceKey]*unknownDevice
+	pruned           time.Time
+}
+
+func NewRegistry(cfg RegistryConfig) *Registry {
+	r := &Registry{
+		devices:          make(map[deviceKey]*Device),
+		dropUnknown:      cfg.DropUnknown,
+		swapWindow:       time.Duration(cfg.SwapWindow) * time.Second,
+		positionInterval: time.Duration(cfg.PositionInterval) * time.Second,
+		unknown:          make(map[deviceKey]*unknownDevice),
+	}
+	if r.swapWindow == 0 {
+		r.swapWindow = DefaultSwapWindow * time.Second
+	}
+	if r.positionInterval == 0 {
+		r.positionInterval = DefaultPositionInterval * time.Second
+	}
+
+	now := time.Now()
+	for _, dc := range cfg.Devices {
+		if dc.CotType == "" {
+			dc.CotType = DefaultSensorCotType
+		}
+		// registered devices count as heard at startup so swaps are not flagged right away
+		dev := &Device{DeviceConfig: dc, lastSeen: now}
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(dev.UID()))
+		dev.Node = h.Sum32()
+		r.devices[deviceKey{dc.Model, dc.ID, dc.Channel}] = dev
+	}
+	return r
+}
+
+// Apply looks up the device of a decoded event and tags the point with its registration.
+// A nil registry keeps every event.
+func (r *Registry) Apply(point *metrics.Point, now time.Time) Match {
+	if r == nil {
+		return Match{}
+	}
+
+	key := deviceKey{point.Tags["model"], point.Tags["id"], point.Tags["channel"]}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dev, ok := r.devices[key]
+	if !ok {
+		dev, ok = r.devices[deviceKey{key.model, key.id, ""}]
+	}
+
+	if ok {
+		dev.lastSeen = now
+		if dev.Name != "" {
+			point.Tags["name"] = dev.Name
+		}
+		if dev.Location != "" {
+			point.Tags["location"] = dev.Location
+		}
+		for k, v := range dev.Tags {
+			point.Tags[k] = v
+		}
+		return Match{Device: dev}
+	}
+
+	match := Match{Drop: r.dropUnknown}
+	unknown, seen := r.unknown[key]
+	if !seen {
+		log.Infof("rtl_433: unregistered device model [%s] id [%s] channel [%s]", key.model, key.id, key.channel)
+		r.pruneUnknown(now)
+		unknown = &unknownDevice{}
+		r.unknown[key] = unknown
+	}
+	unknown.lastSeen = now
+
+	// the old device may pass the swap window after the new id was first heard
+	if !unknown.flagged {
+		match.Swap = r.swapCandidate(key, now)
+		unknown.flagged = match.Swap != nil
+	}
+
+	return match
+}
+
+// PositionDue reports whether the static position of a device should be posted to TAK and,
+// if so, records it as posted. Sensors are rate limited here rather than by the position
+// filter, their node numbers live apart from those of mesh nodes.
+func (r *Registry) PositionDue(dev *Device, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !dev.lastPosted.IsZero() && now.Sub(dev.lastPosted) < r.positionInterval {
+		return false
+	}
+	dev.lastPosted = now
+	return true
+}
+
+// pruneUnknown forgets unregistered devices silent for unknownTTL, checked at most once an
+// hour, and the least recently heard one when the table is full
+func (r *Registry) pruneUnknown(now time.Time) {
+	if now.Sub(r.pruned) >= time.Hour {
+		r.pruned = now
+		for key, u := range r.unknown {
+			if now.Sub(u.lastSeen) >= unknownTTL {
+				delete(r.unknown, key)
+			}
+		}
+	}
+
+	if len(r.unknown) < maxUnknown {
+		return
+	}
+	var oldest deviceKey
+	var oldestSeen time.Time
+	for key, u := range r.unknown {
+		if oldestSeen.IsZero() || u.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = key, u.lastSeen
+		}
+	}
+	delete(r.unknown, oldest)
+}
+
+// swapCandidate finds a silent registered device of the same model and channel that the
+// new id may belong to after a battery change
+func (r *Registry) swapCandidate(key deviceKey, now time.Time) *metrics.Point {
+	for _, dev := range r.devices {
+		if dev.Model != key.model || (dev.Channel != "" && dev.Channel != key.channel) {
+			continue
+		}
+		if now.Sub(dev.lastSeen) < r.swapWindow {
+			continue
+		}
+
+		log.Warnf("rtl_433: new id [%s] for model [%s] while [%s] (id [%s]) is silent since %s, battery swap? re-map it in the registry",
+			key.id, key.model, dev.Name, dev.ID, dev.lastSeen.Format(time.RFC3339))
+
+		return &metrics.Point{
+			Measurement: swapMeasurement,
+			Tags: map[string]string{
+				"model":   key.model,
+				"channel": key.channel,
+				"name":    dev.Name,
+				"old_id":  dev.ID,
+				"new_id":  key.id,
+			},
+			Fields: map[string]interface{}{
+				"silent_seconds": now.Sub(dev.lastSeen).Seconds(),
+			},
+			Time: now,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package shared
+
+import mqtt "github.com/eclipse/paho.mqtt.golang"
+
+// LocalMessage carries a payload from a non-MQTT input through the plugin dispatch. It
+// satisfies mqtt.Message so plugins cannot tell it from broker traffic.
+type LocalMessage struct {
+	TopicName string
+	Body      []byte
+}
+
+func (m *LocalMessage) Duplicate() bool {
+	return false
+}
+
+func (m *LocalMessage) Qos() byte {
+	return 0
+}
+
+func (m *LocalMessage) Retained() bool {
+	return false
+}
+
+func (m *LocalMessage) Topic() string {
+	return m.TopicName
+}
+
+func (m *LocalMessage) MessageID() uint16 {
+	return 0
+}
+
+func (m *LocalMessage) Payload() []byte {
+	return m.Body
+}
+
+func (m *LocalMessage) Ack() {
+}
+
+// V5Message carries an MQTT v5 publish through the plugin dispatch, which is built on the
+// MQTT 3.1.1 client's message interface
+type V5Message struct {
+	LocalMessage
+	QoS        byte
+	Retain     bool
+	PacketID   uint16
+	Properties map[string]string
+}
+
+func (m *V5Message) Qos() byte {
+	return m.QoS
+}
+
+func (m *V5Message) Retained() bool {
+	return m.Retain
+}
+
+func (m *V5Message) MessageID() uint16 {
+	return m.PacketID
+}
+
+func (m *V5Message) UserProperties() map[string]string {
+	return m.Properties
+}
+
+// UserProperties returns the MQTT v5 user properties of a message, nil if it has none
+func UserProperties(msg mqtt.Message) map[string]string {
+	if m, ok := msg.(interface{ UserProperties() map[string]string }); ok {
+		return m.UserProperties()
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/position"
+	"gomqttenc/rtl433"
+	"gomqttenc/tak"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// PluginAPIVersion is the version of the Plugin interface, bumped on incompatible changes.
+// Plugins report the version they were built against and the host refuses any other.
+const PluginAPIVersion = 1
+
+// Plugin is the lifecycle plugin interface. Init is called once with the options of the
+// topic config before the first message and Close on shutdown. Each topic config using a
+// plugin with different options gets its own instance.
+type Plugin interface {
+	APIVersion() int
+	Init(config json.RawMessage, services *PluginServices) error
+	Process(topic string, msg mqtt.Message) error
+	Close() error
+}
+
+var (
+	ErrPluginPanic    = errors.New("plugin panicked")
+	ErrPluginDisabled = errors.New("plugin disabled by its circuit breaker")
+)
+
+// PluginError is the failure of one plugin invocation
+type PluginError struct {
+	Plugin string
+	Topic  string
+	Err    error
+}
+
+func (e *PluginError) Error() string {
+	return fmt.Sprintf("plugin [%s] on [%s]: %s", e.Plugin, e.Topic, e.Err)
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// Channel keys by name (and !node for PKI keys) and by channel hash
+type KeyStore struct {
+	ByName       map[string]Key
+	ByChannelNum map[uint32]Key
+}
+
+// PluginServices is what a plugin can use: the key store, the Telegraf and TAK sinks, the
+// transform stage, the shared node state and metric mapping rules, a logger and a metrics
+// helper both labelled with the plugin name. Messages sent to Telegraf as they are go
+// through the transform in the publisher, a message also posted to TAK is transformed by
+// the plugin with ApplyTransform first.
+type PluginServices struct {
+	Keys           KeyStore
+	Telegraf       chan TelegrafChannelMessage
+	TAK            *tak.Poster
+	Identities     *tak.IdentityRegistry
+	PositionFilter *position.Filter
+	RTL433         *rtl433.Decoder
+	RTL433Devices  *rtl433.Registry
+	Mappings       []MappingRule
+	Transform      MessageTransform
+	Log            *log.Logger
+
+	plugin string
+}
+
+// NewPluginServices exposes the pipeline of ctx to plugins
+func NewPluginServices(ctx *MqttMessageHandlerContext) (*PluginServices, error) {
+	telegrafChan, ok := (ctx.TelegrafChan).(chan TelegrafChannelMessage)
+	if !ok {
+		return nil, errors.New("failed to cast expected data to chan shared.TelegrafChannelMessage")
+	}
+
+	return &PluginServices{
+		Keys: KeyStore{
+			ByName:       ctx.ChannelKeys,
+			ByChannelNum: ctx.ChannelKeysByChannelNum,
+		},
+		Telegraf:       telegrafChan,
+		TAK:            ctx.TAK,
+		Identities:     ctx.Identities,
+		PositionFilter: ctx.PositionFilter,
+		RTL433:         ctx.RTL433,
+		RTL433Devices:  ctx.RTL433Devices,
+		Mappings:       ctx.Mappings,
+		Transform:      ctx.Transform,
+		Log:            log.Default(),
+	}, nil
+}
+
+// ForPlugin returns the services handed to the Init of plugin name
+func (s *PluginServices) ForPlugin(name string) *PluginServices {
+	c := *s
+	c.plugin = name
+	c.Log = log.Default().WithPrefix(name)
+	return &c
+}
+
+// Metric sends a point tagged with the plugin name to Telegraf
+func (s *PluginServices) Metric(point metrics.Point) {
+	tags := make(map[string]string, len(point.Tags)+1)
+	for k, v := range point.Tags {
+		tags[k] = v
+	}
+	tags["plugin"] = s.plugin
+	point.Tags = tags
+
+	s.Telegraf <- point
+}
+
+// DecodePluginOptions decodes the options of a plugin config into v, rejecting unknown
+// fields. Plugins without options pass a pointer to an empty struct.
+func DecodePluginOptions(config json.RawMessage, v interface{}) error {
+	if len(bytes.TrimSpace(config)) == 0 || bytes.Equal(bytes.TrimSpace(config), []byte("null")) {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid plugin options: %w", err)
+	}
+	return nil
+}
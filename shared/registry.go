@@ -0,0 +1,49 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = make(map[string]func() Plugin)
+)
+
+// RegisterPlugin makes a compiled-in plugin available by name, factory returns a new
+// instance for every topic config using it. Plugins call it from init, registering the
+// same name twice panics.
+func RegisterPlugin(name string, factory func() Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	if factory == nil {
+		panic("shared: RegisterPlugin factory is nil")
+	}
+	if _, dup := plugins[name]; dup {
+		panic("shared: RegisterPlugin called twice for plugin " + name)
+	}
+	plugins[name] = factory
+}
+
+// NewPlugin returns a new instance of the compiled-in plugin registered as name
+func NewPlugin(name string) (Plugin, error) {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	factory, ok := plugins[name]
+	if !ok {
+		return nil, fmt.Errorf("no compiled-in plugin [%s], available: %v", name, pluginNames())
+	}
+	return factory(), nil
+}
+
+func pluginNames() []string {
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
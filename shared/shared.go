@@ -1,8 +1,14 @@
 package shared
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"gomqttenc/metrics"
+	"gomqttenc/position"
+	"gomqttenc/rtl433"
+	"gomqttenc/tak"
 
 	"github.com/charmbracelet/log"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -15,6 +21,8 @@ var (
 	ErrMeshHandlerError   = errors.New("failed to handle Mesh Topc")
 )
 
+// MqttPluginHandler is the plugin interface before the lifecycle API, still accepted from
+// .so plugins exporting Handler
 type MqttPluginHandler interface {
 	Process(name string, ctx interface{}, msg mqtt.Message) error
 }
@@ -30,9 +38,69 @@ type TelegrafChannelMessage interface{}
 
 // Application Config
 type PluginConfig struct {
-	Name string `json:"name"`
-	Path string `json:"path"`
-	QoS  byte   `json:"qos"`
+	Name     string                `json:"name"`
+	Path     string                `json:"path"`
+	QoS      byte                  `json:"qos"`
+	Options  json.RawMessage       `json:"options"`
+	External *ExternalPluginConfig `json:"external"`
+	Breaker  *PluginBreakerConfig  `json:"breaker"`
+}
+
+// PluginConfigs lists the plugins of one topic filter, each message matching the filter
+// goes to all of them. The config takes a single plugin object or an array of them.
+type PluginConfigs []PluginConfig
+
+func (p *PluginConfigs) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '[' {
+		var single PluginConfig
+		if err := json.Unmarshal(data, &single); err != nil {
+			return err
+		}
+		*p = PluginConfigs{single}
+		return nil
+	}
+
+	var list []PluginConfig
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return errors.New("empty plugin list")
+	}
+	*p = list
+	return nil
+}
+
+// QoS is the highest QoS asked for by the plugins of a filter
+func (p PluginConfigs) QoS() byte {
+	var qos byte
+	for _, plugin := range p {
+		qos = max(qos, plugin.QoS)
+	}
+	return qos
+}
+
+// Circuit breaker disabling a plugin that keeps failing. Within each Window the plugin is
+// disabled for Cooldown once MaxPanics panics or, after MinCalls calls, a failure ratio of
+// MaxFailureRatio is reached. After the cooldown one call probes whether it recovered.
+type PluginBreakerConfig struct {
+	Disabled        bool    `json:"disabled"`
+	Window          int     `json:"window_s"`
+	MinCalls        int     `json:"min_calls"`
+	MaxFailureRatio float64 `json:"max_failure_ratio"`
+	MaxPanics       int     `json:"max_panics"`
+	Cooldown        int     `json:"cooldown_s"`
+}
+
+// Child process running an out-of-process plugin, see package plugins/external for the
+// protocol. Timeout bounds each message, a plugin missing a health check is restarted.
+type ExternalPluginConfig struct {
+	Command         []string `json:"command"`
+	Dir             string   `json:"dir"`
+	Env             []string `json:"env"`
+	Timeout         int      `json:"timeout_ms"`
+	HealthInterval  int      `json:"health_interval_s"`
+	MaxRestartDelay int      `json:"max_restart_delay_s"`
 }
 
 type TAKCertsConfig struct {
@@ -41,25 +109,204 @@ type TAKCertsConfig struct {
 	CACert string `json:"ca_cert"`
 }
 
+// TLS settings of an MQTT broker connection. The client certificate is either a PEM
+// cert/key pair or a PKCS12 file.
+type BrokerTLSConfig struct {
+	CACert             string `json:"ca_cert"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	PKCS12             string `json:"pkcs12"`
+	Passwd             string `json:"passwd"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// MQTT session behaviour. A persistent session (CleanSession false) keeps QoS 1 and 2
+// messages in StoreDir/<broker name> so they survive restarts.
+type BrokerSessionConfig struct {
+	PersistentSession    bool   `json:"persistent_session"`
+	StoreDir             string `json:"store_dir"`
+	MaxReconnectInterval int    `json:"max_reconnect_interval_s"`
+}
+
+// One MQTT broker connection with its own credentials, TLS settings and topic to plugin
+// table. Name identifies the broker in logs, metrics and the TAK bridge config. Protocol
+// is "3" (MQTT 3.1.1, the default) or "5". With a SharedGroup the topics are subscribed as
+// $share/<group>/<topic> so several instances split the messages between them.
+type BrokerConfig struct {
+	Name        string                   `json:"name"`
+	URL         string                   `json:"url"`
+	Protocol    string                   `json:"protocol"`
+	SharedGroup string                   `json:"shared_group"`
+	ClientID    string                   `json:"clientID"`
+	Username    string                   `json:"username"`
+	Password    string                   `json:"password"`
+	TLS         BrokerTLSConfig          `json:"tls"`
+	Session     BrokerSessionConfig      `json:"session"`
+	Topics      map[string]PluginConfigs `json:"topics"`
+}
+
+// In-process MQTT broker radios can uplink to. Messages published to it go through the
+// plugins of Topics (the local input table when empty) and the topics listed by each
+// bridge are forwarded to a configured upstream broker.
+type EmbeddedBrokerConfig struct {
+	Enabled        bool                     `json:"enabled"`
+	Listeners      []BrokerListenerConfig   `json:"listeners"`
+	AllowAnonymous bool                     `json:"allow_anonymous"`
+	AnonymousACL   map[string]string        `json:"anonymous_acl"`
+	Users          []BrokerUserConfig       `json:"users"`
+	Topics         map[string]PluginConfigs `json:"topics"`
+	Bridges        []BrokerBridgeConfig     `json:"bridges"`
+}
+
+// Listener of the embedded broker, Type is tcp or ws. Cert and Key enable TLS.
+type BrokerListenerConfig struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Cert    string `json:"cert"`
+	Key     string `json:"key"`
+}
+
+// User of the embedded broker. ACL maps topic filters to r, w, rw or deny; a user with
+// an ACL can only use the topics it lists.
+type BrokerUserConfig struct {
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	ACL      map[string]string `json:"acl"`
+}
+
+// Forwarding of embedded broker topics to the upstream broker named Broker. Topics must not
+// overlap the topics subscribed on Broker, forwarded messages would come back from it and
+// go through the plugins a second time.
+type BrokerBridgeConfig struct {
+	Broker string   `json:"broker"`
+	Topics []string `json:"topics"`
+	QoS    byte     `json:"qos"`
+}
+
+// Dispatch stage between the message sources and the plugins. Overflow is block (the
+// default), drop_newest or drop_oldest. DrainTimeout bounds the wait on shutdown.
+type DispatchConfig struct {
+	Workers      int    `json:"workers"`
+	QueueSize    int    `json:"queue_size"`
+	Overflow     string `json:"overflow"`
+	DrainTimeout int    `json:"drain_timeout_s"`
+}
+
+// Starlark script run on every message before it reaches Telegraf or TAK, see package
+// transform. The script is reloaded when it changes on disk, Timeout and MaxSteps bound each call.
+type TransformConfig struct {
+	Script         string `json:"script"`
+	Timeout        int    `json:"timeout_ms"`
+	MaxSteps       uint64 `json:"max_steps"`
+	ReloadInterval int    `json:"reload_interval_s"`
+}
+
+// MessageTransform is the transform stage of package transform. Run returns the message as
+// changed by the script, false when the script dropped it, and the points it emitted.
+type MessageTransform interface {
+	Run(msg TelegrafChannelMessage) (TelegrafChannelMessage, bool, []metrics.Point)
+}
+
+// Transformed is a message that already went through the transform stage, the publisher
+// sends it to Telegraf as is
+type Transformed struct {
+	Message TelegrafChannelMessage
+}
+
+// ApplyTransform runs msg through the transform stage before it fans out to the sinks, used
+// by plugins posting a message to TAK as well as Telegraf. The emitted points are sent to
+// Telegraf, ok is false when the script dropped the message.
+func ApplyTransform(transform MessageTransform, msg TelegrafChannelMessage, telegrafChannel chan TelegrafChannelMessage) (TelegrafChannelMessage, bool) {
+	if transform == nil {
+		return msg, true
+	}
+
+	changed, ok, emitted := transform.Run(msg)
+	for _, point := range emitted {
+		telegrafChannel <- Transformed{Message: point}
+	}
+	return changed, ok
+}
+
+// Rule exporting the messages of a portnum, a topic filter or both as a measurement, see
+// package mapping. Time is the path of a unix time in seconds, the receive time otherwise.
+type MappingRule struct {
+	Name        string         `json:"name"`
+	Portnum     string         `json:"portnum"`
+	Topic       string         `json:"topic"`
+	Measurement string         `json:"measurement"`
+	Tags        []MappingField `json:"tags"`
+	Fields      []MappingField `json:"fields"`
+	Time        string         `json:"time"`
+}
+
+// Value at Path exported as Name, the last path element by default. Numbers are multiplied
+// by Scale then Offset is added, Type (int, float, string or bool) forces the exported type.
+type MappingField struct {
+	Path   string  `json:"path"`
+	Name   string  `json:"name"`
+	Scale  float64 `json:"scale"`
+	Offset float64 `json:"offset"`
+	Type   string  `json:"type"`
+}
+
+// TAK to mesh position bridge
+type TAKBridgeConfig struct {
+	Enabled          bool   `json:"enabled"`
+	Server           string `json:"server"`
+	Broker           string `json:"broker"`
+	Channel          string `json:"channel"`
+	TopicRoot        string `json:"topic_root"`
+	HopLimit         uint32 `json:"hop_limit"`
+	MinInterval      int    `json:"min_interval_s"`
+	MaxPerMinute     int    `json:"max_per_minute"`
+	NodeInfoInterval int    `json:"nodeinfo_interval_s"`
+}
+
+// Non-MQTT input source. Its messages are dispatched to the plugin of Topic. Address is
+// host:port for network inputs and the device path for serial ones.
+type InputConfig struct {
+	Type      string `json:"type"`
+	Address   string `json:"address"`
+	Topic     string `json:"topic"`
+	Baud      int    `json:"baud"`
+	Interface string `json:"interface"`
+}
+
 type TAKCerts struct {
 	TLSClientConfig *tls.Config
 }
 
 // Config
 type Config struct {
-	TAKCerts    TAKCertsConfig          `json:"tak_certs"`
-	TAKServer   string                  `json:"tak"`
-	Broker      string                  `json:"broker"`
-	Topics      map[string]PluginConfig `json:"topics"`
-	ClientID    string                  `json:"clientID"`
-	Username    string                  `json:"username"`
-	Password    string                  `json:"password"`
-	B64Keys     []map[string]string     `json:"b64Key"`
-	TelegrafURL string                  `json:"telegrafURL"`
+	TAKCerts       TAKCertsConfig           `json:"tak_certs"`
+	TAKServer      string                   `json:"tak"`
+	Brokers        []BrokerConfig           `json:"brokers"`
+	Broker         string                   `json:"broker"`
+	EmbeddedBroker EmbeddedBrokerConfig     `json:"embedded_broker"`
+	Dispatch       DispatchConfig           `json:"dispatch"`
+	PluginBreaker  PluginBreakerConfig      `json:"plugin_breaker"`
+	Transform      TransformConfig          `json:"transform"`
+	BrokerTLS      BrokerTLSConfig          `json:"broker_tls"`
+	BrokerSession  BrokerSessionConfig      `json:"broker_session"`
+	Topics         map[string]PluginConfigs `json:"topics"`
+	ClientID       string                   `json:"clientID"`
+	Username       string                   `json:"username"`
+	Password       string                   `json:"password"`
+	B64Keys        []map[string]string      `json:"b64Key"`
+	TelegrafURL    string                   `json:"telegrafURL"`
+	TAKIdentity    tak.IdentityConfig       `json:"tak_identity"`
+	PositionFilter position.FilterConfig    `json:"position_filter"`
+	TAKHTTP        tak.HTTPConfig           `json:"tak_http"`
+	TAKBridge      TAKBridgeConfig          `json:"tak_bridge"`
+	Inputs         []InputConfig            `json:"inputs"`
+	RTL433         rtl433.Config            `json:"rtl433"`
+	Mappings       []MappingRule            `json:"mappings"`
 }
 
 // Plugins Map
-type MqttPluginHandlers map[string]MqttPluginHandler
+type MqttPluginHandlers map[string][]MqttPluginHandler
 
 // MqttMessageHandlerContext
 
@@ -70,6 +317,13 @@ type MqttMessageHandlerContext struct {
 	ChannelKeysByChannelNum map[uint32]Key
 	TAKServer               string
 	TAKCerts                TAKCerts
+	TAK                     *tak.Poster
+	Identities              *tak.IdentityRegistry
+	PositionFilter          *position.Filter
+	RTL433                  *rtl433.Decoder
+	RTL433Devices           *rtl433.Registry
+	Mappings                []MappingRule
+	Transform               MessageTransform
 }
 
 // Meshtastic message processing function unmarshaling and return the contents in a string
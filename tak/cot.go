@@ -0,0 +1,104 @@
+package tak
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// CoTEvent is the subset of a Cursor-on-Target event needed to bridge positions
+type CoTEvent struct {
+	XMLName xml.Name  `xml:"event"`
+	Version string    `xml:"version,attr"`
+	UID     string    `xml:"uid,attr"`
+	Type    string    `xml:"type,attr"`
+	How     string    `xml:"how,attr"`
+	Time    string    `xml:"time,attr"`
+	Start   string    `xml:"start,attr"`
+	Stale   string    `xml:"stale,attr"`
+	Point   CoTPoint  `xml:"point"`
+	Detail  CoTDetail `xml:"detail"`
+}
+
+type CoTPoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+	Hae float64 `xml:"hae,attr"`
+	Ce  float64 `xml:"ce,attr"`
+	Le  float64 `xml:"le,attr"`
+}
+
+type CoTDetail struct {
+	Contact *struct {
+		Callsign string `xml:"callsign,attr"`
+	} `xml:"contact"`
+	Group *struct {
+		Name string `xml:"name,attr"`
+		Role string `xml:"role,attr"`
+	} `xml:"__group"`
+	Track *struct {
+		Speed  float64 `xml:"speed,attr"`
+		Course float64 `xml:"course,attr"`
+	} `xml:"track"`
+}
+
+// IsPLI reports whether the event is a position report of an atom (a person or unit)
+func (e *CoTEvent) IsPLI() bool {
+	return strings.HasPrefix(e.Type, "a-") && !(e.Point.Lat == 0 && e.Point.Lon == 0)
+}
+
+// Callsign returns the contact callsign of the event, or its UID if none was sent
+func (e *CoTEvent) Callsign() string {
+	if e.Detail.Contact != nil && e.Detail.Contact.Callsign != "" {
+		return e.Detail.Contact.Callsign
+	}
+	return e.UID
+}
+
+// ReadCoTEvents decodes the stream of back-to-back <event> documents sent by a TAK Server
+// and calls fn for each of them until the reader fails
+func ReadCoTEvents(r io.Reader, fn func(*CoTEvent)) error {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "event" {
+			continue
+		}
+
+		var ev CoTEvent
+		if err := d.DecodeElement(&ev, &start); err != nil {
+			return fmt.Errorf("decode CoT event: %w", err)
+		}
+		fn(&ev)
+	}
+}
+
+// DialStream opens a TLS connection to the streaming port of a TAK Server
+func DialStream(ctx context.Context, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second},
+		Config:    tlsConfig,
+	}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// PingEvent returns a t-x-c-t keepalive event for a streaming connection
+func PingEvent(uid string, now time.Time) []byte {
+	ts := now.UTC().Format(time.RFC3339)
+	stale := now.Add(time.Minute).UTC().Format(time.RFC3339)
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>`+
+		`<event version="2.0" uid="%s" type="t-x-c-t" how="h-g-i-g-o" time="%s" start="%s" stale="%s">`+
+		`<point lat="0" lon="0" hae="0" ce="9999999" le="9999999"/><detail/></event>`, uid, ts, ts, stale))
+}
@@ -0,0 +1,239 @@
+package tak
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUIDPrefix = "MESHTASTIC-"
+	DefaultTeam      = "Cyan"
+	DefaultRole      = "Team Member"
+	DefaultCotType   = "a-f-G-U-C"
+)
+
+// virtual nodes of TAK users not seen for bridgedTTL are forgotten, at most
+// maxBridgedNodes are kept
+const (
+	bridgedTTL      = 24 * time.Hour
+	maxBridgedNodes = 4096
+)
+
+// IdentityEntry describes how a mesh node is presented to TAK. Empty values fall back
+// to the configured defaults.
+type IdentityEntry struct {
+	UID      string  `json:"uid"`
+	Callsign string  `json:"callsign"`
+	Team     string  `json:"team"`
+	Role     string  `json:"role"`
+	CotType  string  `json:"cot_type"`
+	Serial   float64 `json:"serial"`
+}
+
+// IdentityConfig is the tak_identity section of the application config. Nodes are keyed
+// by node id, either in "!hex" form or as a decimal node number.
+type IdentityConfig struct {
+	UIDPrefix string                   `json:"uid_prefix"`
+	Defaults  IdentityEntry            `json:"defaults"`
+	Nodes     map[string]IdentityEntry `json:"nodes"`
+}
+
+// Identity is the fully resolved TAK identity of a mesh node
+type Identity struct {
+	Node     uint32
+	UID      string
+	Callsign string
+	Team     string
+	Role     string
+	CotType  string
+	Serial   float64
+}
+
+type learnedName struct {
+	longName  string
+	shortName string
+}
+
+// IdentityRegistry maps mesh node numbers to TAK identities. Static entries come from the
+// config, callsigns are learned from NodeInfo and MapReport packets.
+type IdentityRegistry struct {
+	mu        sync.RWMutex
+	uidPrefix string
+	defaults  IdentityEntry
+	nodes     map[uint32]IdentityEntry
+	learned   map[uint32]learnedName
+	bridged   map[uint32]time.Time
+	pruned    time.Time
+}
+
+// ParseNodeID converts a "!hex" node id or a decimal node number to a node number
+func ParseNodeID(id string) (uint32, error) {
+	if strings.HasPrefix(id, "!") {
+		n, err := strconv.ParseUint(id[1:], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid node id [%s]: %w", id, err)
+		}
+		return uint32(n), nil
+	}
+
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid node id [%s]: %w", id, err)
+	}
+	return uint32(n), nil
+}
+
+func NewIdentityRegistry(cfg IdentityConfig) (*IdentityRegistry, error) {
+	r := &IdentityRegistry{
+		uidPrefix: cfg.UIDPrefix,
+		defaults:  cfg.Defaults,
+		nodes:     make(map[uint32]IdentityEntry),
+		learned:   make(map[uint32]learnedName),
+		bridged:   make(map[uint32]time.Time),
+	}
+	if r.uidPrefix == "" {
+		r.uidPrefix = DefaultUIDPrefix
+	}
+
+	for id, entry := range cfg.Nodes {
+		node, err := ParseNodeID(id)
+		if err != nil {
+			return nil, err
+		}
+		r.nodes[node] = entry
+	}
+
+	return r, nil
+}
+
+// Learn records the names a node announced about itself
+func (r *IdentityRegistry) Learn(node uint32, longName, shortName string) {
+	if r == nil || (longName == "" && shortName == "") {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.learned[node] = learnedName{longName: longName, shortName: shortName}
+}
+
+// Resolve returns the TAK identity for a node. A nil registry resolves every node to the
+// built-in defaults.
+func (r *IdentityRegistry) Resolve(node uint32) Identity {
+	var (
+		entry    IdentityEntry
+		defaults IdentityEntry
+		learned  learnedName
+		prefix   = DefaultUIDPrefix
+	)
+
+	if r != nil {
+		r.mu.RLock()
+		entry = r.nodes[node]
+		learned = r.learned[node]
+		defaults = r.defaults
+		prefix = r.uidPrefix
+		r.mu.RUnlock()
+	}
+
+	nodeID := fmt.Sprintf("!%08x", node)
+
+	id := Identity{
+		Node:     node,
+		UID:      firstNonEmpty(entry.UID, prefix+nodeID),
+		Callsign: firstNonEmpty(entry.Callsign, learned.longName, learned.shortName, nodeID),
+		Team:     firstNonEmpty(entry.Team, defaults.Team, DefaultTeam),
+		Role:     firstNonEmpty(entry.Role, defaults.Role, DefaultRole),
+		CotType:  firstNonEmpty(entry.CotType, defaults.CotType, DefaultCotType),
+		Serial:   entry.Serial,
+	}
+	if id.Serial == 0 {
+		id.Serial = float64(node)
+	}
+
+	return id
+}
+
+// IsMeshUID reports whether a TAK UID belongs to a mesh node, so events we produced
+// ourselves are not bridged back into the mesh
+func (r *IdentityRegistry) IsMeshUID(uid string) bool {
+	prefix := DefaultUIDPrefix
+	if r != nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		prefix = r.uidPrefix
+		for _, entry := range r.nodes {
+			if entry.UID != "" && entry.UID == uid {
+				return true
+			}
+		}
+	}
+	return strings.HasPrefix(uid, prefix)
+}
+
+// MarkBridged records a virtual node that carries a TAK user into the mesh, for bridgedTTL
+// after the user was last seen
+func (r *IdentityRegistry) MarkBridged(node uint32) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := r.bridged[node]; !ok {
+		r.pruneBridged(now)
+	}
+	r.bridged[node] = now
+}
+
+// pruneBridged forgets virtual nodes whose TAK user expired, checked at most once a minute,
+// and the least recently seen node when the table is full
+func (r *IdentityRegistry) pruneBridged(now time.Time) {
+	if now.Sub(r.pruned) >= time.Minute {
+		r.pruned = now
+		for node, seen := range r.bridged {
+			if now.Sub(seen) >= bridgedTTL {
+				delete(r.bridged, node)
+			}
+		}
+	}
+
+	if len(r.bridged) < maxBridgedNodes {
+		return
+	}
+	var oldest uint32
+	var oldestSeen time.Time
+	for node, seen := range r.bridged {
+		if oldestSeen.IsZero() || seen.Before(oldestSeen) {
+			oldest, oldestSeen = node, seen
+		}
+	}
+	delete(r.bridged, oldest)
+}
+
+// IsBridged reports whether a node is a virtual node created by the TAK bridge. Its
+// positions already originate from TAK and must not be posted back.
+func (r *IdentityRegistry) IsBridged(node uint32) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen, ok := r.bridged[node]
+	return ok && time.Since(seen) < bridgedTTL
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
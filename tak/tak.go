@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -21,11 +20,46 @@ type Telemetry struct {
 	SolarPower   float64   `json:"solar power"` // Strings in your sample payload
 	Speed        float64   `json:"Speed"`       // Strings in your sample payload
 	Heading      int       `json:"Heading"`
+
+	// the identity is posted by templates, or with identity_fields, see Poster
+	UID      string `json:"-"`
+	Callsign string `json:"-"`
+	Team     string `json:"-"`
+	Role     string `json:"-"`
+	CotType  string `json:"-"`
+
+	// Node and Fields are only used by templated posters
+	Node   uint32                 `json:"-"`
+	Fields map[string]interface{} `json:"-"`
+}
+
+// identityTelemetry is the fixed Telemetry shape with the identity of the node added
+type identityTelemetry struct {
+	Telemetry
+	UID      string `json:"uid,omitempty"`
+	Callsign string `json:"callsign,omitempty"`
+	Team     string `json:"team,omitempty"`
+	Role     string `json:"role,omitempty"`
+	CotType  string `json:"cot_type,omitempty"`
 }
 
-// PostTelemetry sends the JSON to the endpoint, optionally skipping TLS verification
-// (equivalent to curl --insecure). It returns the response body bytes.
-func PostTelemetryTAK(ctx context.Context, endpoint string, tlsConfig *tls.Config, data Telemetry, insecureTLS bool) ([]byte, error) {
+// NewTelemetry builds the telemetry record for a position report from a resolved identity
+func NewTelemetry(id Identity, latitude, longitude float64) Telemetry {
+	return Telemetry{
+		Node:         id.Node,
+		SerialNumber: id.Serial,
+		DateTime:     time.Now(),
+		Latitude:     latitude,
+		Longitude:    longitude,
+		UID:          id.UID,
+		Callsign:     id.Callsign,
+		Team:         id.Team,
+		Role:         id.Role,
+		CotType:      id.CotType,
+	}
+}
+
+func postJSON(ctx context.Context, endpoint string, tlsConfig *tls.Config, body []byte, headers map[string]string) ([]byte, error) {
 	// TLS transport that can skip certificate verification when requested.
 
 	// TODO LEAVE OUT tlsConfig.InsecureSkipVerify = insecureTLS
@@ -39,18 +73,15 @@ func PostTelemetryTAK(ctx context.Context, endpoint string, tlsConfig *tls.Confi
 		Timeout:   15 * time.Second,
 	}
 
-	// Marshal to JSON.
-	body, err := json.Marshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("marshal telemetry: %w", err)
-	}
-
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("build request: %w", err)
 	}
 	req.Header.Set("Connection", "close")
 	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
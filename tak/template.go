@@ -0,0 +1,223 @@
+package tak
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var placeholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.]+)\s*\}\}`)
+
+// telemetry of nodes not heard for telemetryTTL is forgotten, at most maxTelemetryNodes
+// are kept
+const (
+	telemetryTTL      = 6 * time.Hour
+	maxTelemetryNodes = 4096
+)
+
+// HTTPConfig is the tak_http section of the application config. Template is an arbitrary
+// JSON document whose string values may reference record fields as {{name}}. A string
+// holding a single placeholder is replaced by the typed value, otherwise the values are
+// interpolated as text. Without a template the fixed Telemetry shape is posted, with the
+// uid, callsign, team, role and cot_type of the node added when IdentityFields is set.
+type HTTPConfig struct {
+	Template       json.RawMessage   `json:"template"`
+	Headers        map[string]string `json:"headers"`
+	BearerToken    string            `json:"bearer_token"`
+	IdentityFields bool              `json:"identity_fields"`
+}
+
+// Poster posts position records to an HTTP telemetry endpoint
+type Poster struct {
+	endpoint  string
+	tlsConfig *tls.Config
+	template  interface{}
+	headers   map[string]string
+	identity  bool
+
+	mu        sync.RWMutex
+	telemetry map[uint32]*nodeTelemetry
+	pruned    time.Time
+}
+
+type nodeTelemetry struct {
+	values  map[string]interface{}
+	updated time.Time
+}
+
+func NewPoster(endpoint string, tlsConfig *tls.Config, cfg HTTPConfig) (*Poster, error) {
+	p := &Poster{
+		endpoint:  endpoint,
+		tlsConfig: tlsConfig,
+		headers:   make(map[string]string),
+		identity:  cfg.IdentityFields,
+		telemetry: make(map[uint32]*nodeTelemetry),
+	}
+
+	if len(cfg.Template) > 0 {
+		if err := json.Unmarshal(cfg.Template, &p.template); err != nil {
+			return nil, fmt.Errorf("invalid tak_http template: %w", err)
+		}
+	}
+
+	for k, v := range cfg.Headers {
+		p.headers[k] = v
+	}
+	if cfg.BearerToken != "" {
+		p.headers["Authorization"] = "Bearer " + cfg.BearerToken
+	}
+
+	return p, nil
+}
+
+// RecordTelemetry remembers the latest telemetry values of a node so later position
+// records can reference them as {{telemetry.<name>}}, for telemetryTTL
+func (p *Poster) RecordTelemetry(node uint32, values map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	latest, ok := p.telemetry[node]
+	if !ok {
+		p.pruneTelemetry(now)
+		latest = &nodeTelemetry{values: make(map[string]interface{})}
+		p.telemetry[node] = latest
+	}
+	latest.updated = now
+	for k, v := range values {
+		latest.values[k] = v
+	}
+}
+
+// pruneTelemetry forgets nodes whose telemetry expired, checked at most once a minute, and
+// the least recently updated node when the table is full
+func (p *Poster) pruneTelemetry(now time.Time) {
+	if now.Sub(p.pruned) >= time.Minute {
+		p.pruned = now
+		for node, t := range p.telemetry {
+			if now.Sub(t.updated) >= telemetryTTL {
+				delete(p.telemetry, node)
+			}
+		}
+	}
+
+	if len(p.telemetry) < maxTelemetryNodes {
+		return
+	}
+	var oldest uint32
+	var oldestUpdate time.Time
+	for node, t := range p.telemetry {
+		if oldestUpdate.IsZero() || t.updated.Before(oldestUpdate) {
+			oldest, oldestUpdate = node, t.updated
+		}
+	}
+	delete(p.telemetry, oldest)
+}
+
+// EnvelopeFields returns the template fields describing the packet a record came from
+func EnvelopeFields(from, to uint32, topic string) map[string]interface{} {
+	return map[string]interface{}{
+		"envelope.from":     fmt.Sprintf("!%08x", from),
+		"envelope.from_num": from,
+		"envelope.to":       fmt.Sprintf("!%08x", to),
+		"envelope.to_num":   to,
+		"envelope.topic":    topic,
+	}
+}
+
+// Post renders the record through the configured template and posts it
+func (p *Poster) Post(ctx context.Context, data Telemetry) ([]byte, error) {
+	if p.template == nil {
+		var record interface{} = data
+		if p.identity {
+			record = identityTelemetry{
+				Telemetry: data,
+				UID:       data.UID,
+				Callsign:  data.Callsign,
+				Team:      data.Team,
+				Role:      data.Role,
+				CotType:   data.CotType,
+			}
+		}
+		body, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("marshal telemetry: %w", err)
+		}
+		return postJSON(ctx, p.endpoint, p.tlsConfig, body, p.headers)
+	}
+
+	body, err := json.Marshal(render(p.template, p.fields(data)))
+	if err != nil {
+		return nil, fmt.Errorf("marshal templated telemetry: %w", err)
+	}
+	return postJSON(ctx, p.endpoint, p.tlsConfig, body, p.headers)
+}
+
+// fields flattens a record into the names available to templates
+func (p *Poster) fields(data Telemetry) map[string]interface{} {
+	fields := map[string]interface{}{
+		"serial":             data.SerialNumber,
+		"time":               data.DateTime.UTC().Format(time.RFC3339),
+		"time_unix":          data.DateTime.Unix(),
+		"event":              data.Event,
+		"solar_power":        data.SolarPower,
+		"position.latitude":  data.Latitude,
+		"position.longitude": data.Longitude,
+		"position.speed":     data.Speed,
+		"position.heading":   data.Heading,
+		"identity.node":      data.Node,
+		"identity.uid":       data.UID,
+		"identity.callsign":  data.Callsign,
+		"identity.team":      data.Team,
+		"identity.role":      data.Role,
+		"identity.cot_type":  data.CotType,
+	}
+
+	p.mu.RLock()
+	if t, ok := p.telemetry[data.Node]; ok && time.Since(t.updated) < telemetryTTL {
+		for k, v := range t.values {
+			fields["telemetry."+k] = v
+		}
+	}
+	p.mu.RUnlock()
+
+	for k, v := range data.Fields {
+		fields[k] = v
+	}
+
+	return fields
+}
+
+func render(node interface{}, fields map[string]interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			out[k] = render(child, fields)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, child := range v {
+			out[i] = render(child, fields)
+		}
+		return out
+	case string:
+		if m := placeholderRe.FindStringSubmatch(v); m != nil && m[0] == v {
+			return fields[m[1]]
+		}
+		return placeholderRe.ReplaceAllStringFunc(v, func(ph string) string {
+			val, ok := fields[placeholderRe.FindStringSubmatch(ph)[1]]
+			if !ok || val == nil {
+				return ""
+			}
+			return fmt.Sprint(val)
+		})
+	default:
+		return v
+	}
+}
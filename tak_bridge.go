@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"gomqttenc/md"
+	"gomqttenc/shared"
+	"gomqttenc/tak"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/rabarar/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	takBridgePingUID        = "gomqttenc-bridge"
+	takBridgeMinBackoff     = 5 * time.Second
+	takBridgeMaxBackoff     = 2 * time.Minute
+	defaultBridgeHopLimit   = 3
+	defaultBridgeInterval   = 60
+	defaultBridgePerMinute  = 10
+	defaultBridgeNodeInfo   = 30 * 60
+	meshBroadcastAddr       = 0xffffffff
+	meshFirstUsableNodeAddr = 4
+	maxBridgedUsers         = 4096
+)
+
+// takBridge converts TAK PLI events into Meshtastic positions sent from one virtual node
+// per TAK user and publishes them, channel encrypted, to the mesh over MQTT
+type takBridge struct {
+	cfg         shared.TAKBridgeConfig
+	client      brokerClient
+	key         shared.Key
+	channelHash uint32
+	identities  *tak.IdentityRegistry
+
+	mu           sync.Mutex
+	lastPosition map[uint32]time.Time
+	lastNodeInfo map[uint32]time.Time
+	pruned       time.Time
+	tokens       float64
+	lastRefill   time.Time
+}
+
+func newTAKBridge(cfg shared.TAKBridgeConfig, client brokerClient, identities *tak.IdentityRegistry) (*takBridge, error) {
+	key, ok := channelKeys[cfg.Channel]
+	if !ok {
+		return nil, fmt.Errorf("no key configured for TAK bridge channel [%s]", cfg.Channel)
+	}
+	if cfg.Server == "" || cfg.TopicRoot == "" {
+		return nil, fmt.Errorf("TAK bridge needs both server and topic_root")
+	}
+
+	if cfg.HopLimit == 0 {
+		cfg.HopLimit = defaultBridgeHopLimit
+	}
+	if cfg.MinInterval == 0 {
+		cfg.MinInterval = defaultBridgeInterval
+	}
+	if cfg.MaxPerMinute == 0 {
+		cfg.MaxPerMinute = defaultBridgePerMinute
+	}
+	if cfg.NodeInfoInterval == 0 {
+		cfg.NodeInfoInterval = defaultBridgeNodeInfo
+	}
+
+	return &takBridge{
+		cfg:          cfg,
+		client:       client,
+		key:          key,
+		channelHash:  generateHash(cfg.Channel, key.Txt),
+		identities:   identities,
+		lastPosition: make(map[uint32]time.Time),
+		lastNodeInfo: make(map[uint32]time.Time),
+		tokens:       float64(cfg.MaxPerMinute),
+		lastRefill:   time.Now(),
+	}, nil
+}
+
+// run keeps a streaming connection to the TAK Server open until ctx is cancelled
+func (b *takBridge) run(ctx context.Context, tlsConfig *tls.Config) {
+	backoff := takBridgeMinBackoff
+
+	for {
+		start := time.Now()
+		err := b.stream(ctx, tlsConfig)
+		if ctx.Err() != nil {
+			log.Info("TAK bridge shutting down")
+			return
+		}
+		log.Warnf("TAK bridge stream to [%s] ended: %s", b.cfg.Server, err)
+
+		if time.Since(start) > takBridgeMaxBackoff {
+			backoff = takBridgeMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, takBridgeMaxBackoff)
+	}
+}
+
+func (b *takBridge) stream(ctx context.Context, tlsConfig *tls.Config) error {
+	conn, err := tak.DialStream(ctx, b.cfg.Server, tlsConfig)
+	if err != nil {
+		return err
+	}
+	log.Infof("TAK bridge connected to [%s]", b.cfg.Server)
+
+	done := make(chan struct{})
+	defer close(done)
+	go b.keepalive(ctx, conn, done)
+
+	return tak.ReadCoTEvents(conn, b.handleEvent)
+}
+
+// keepalive pings the TAK Server and closes the connection once the stream is done
+func (b *takBridge) keepalive(ctx context.Context, conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Debugf("TAK bridge close: %s", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if _, err := conn.Write(tak.PingEvent(takBridgePingUID, now)); err != nil {
+				log.Warnf("TAK bridge ping failed: %s", err)
+				return
+			}
+		}
+	}
+}
+
+func (b *takBridge) handleEvent(ev *tak.CoTEvent) {
+	if !ev.IsPLI() || ev.UID == takBridgePingUID || b.identities.IsMeshUID(ev.UID) {
+		return
+	}
+
+	node := virtualNodeID(ev.UID)
+	now := time.Now()
+	b.identities.MarkBridged(node)
+
+	if b.nodeInfoDue(node, now) && b.take(now) {
+		if err := b.publishNodeInfo(node, ev); err != nil {
+			log.Errorf("TAK bridge: failed to publish NodeInfo for [%s]: %s", ev.UID, err)
+		} else {
+			b.markNodeInfo(node, now)
+		}
+	}
+
+	if !b.positionDue(node, now) {
+		log.Debugf("TAK bridge: position of [%s] rate limited", ev.UID)
+		return
+	}
+	if !b.take(now) {
+		log.Warnf("TAK bridge: airtime budget exhausted, dropping position of [%s]", ev.UID)
+		return
+	}
+
+	if err := b.publishPosition(node, ev, now); err != nil {
+		log.Errorf("TAK bridge: failed to publish position for [%s]: %s", ev.UID, err)
+		return
+	}
+	b.markPosition(node, now)
+	log.Infof("TAK bridge: [%s] (%s) => mesh node [!%08x]", ev.Callsign(), ev.UID, node)
+}
+
+func (b *takBridge) positionDue(node uint32, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	last, ok := b.lastPosition[node]
+	return !ok || now.Sub(last) >= time.Duration(b.cfg.MinInterval)*time.Second
+}
+
+func (b *takBridge) markPosition(node uint32, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.lastPosition[node]; !ok {
+		b.prune(now)
+	}
+	b.lastPosition[node] = now
+}
+
+func (b *takBridge) nodeInfoDue(node uint32, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	last, ok := b.lastNodeInfo[node]
+	return !ok || now.Sub(last) >= time.Duration(b.cfg.NodeInfoInterval)*time.Second
+}
+
+func (b *takBridge) markNodeInfo(node uint32, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.lastNodeInfo[node]; !ok {
+		b.prune(now)
+	}
+	b.lastNodeInfo[node] = now
+}
+
+// prune forgets the users whose last position or NodeInfo is older than its interval, as
+// they are due again anyway, checked at most once a minute. A full table drops its least
+// recently sent user.
+func (b *takBridge) prune(now time.Time) {
+	if now.Sub(b.pruned) >= time.Minute {
+		b.pruned = now
+		expireTimes(b.lastPosition, now, time.Duration(b.cfg.MinInterval)*time.Second)
+		expireTimes(b.lastNodeInfo, now, time.Duration(b.cfg.NodeInfoInterval)*time.Second)
+	}
+	evictOldest(b.lastPosition, maxBridgedUsers)
+	evictOldest(b.lastNodeInfo, maxBridgedUsers)
+}
+
+func expireTimes(times map[uint32]time.Time, now time.Time, ttl time.Duration) {
+	for node, t := range times {
+		if now.Sub(t) >= ttl {
+			delete(times, node)
+		}
+	}
+}
+
+func evictOldest(times map[uint32]time.Time, max int) {
+	if len(times) < max {
+		return
+	}
+	var oldest uint32
+	var oldestTime time.Time
+	for node, t := range times {
+		if oldestTime.IsZero() || t.Before(oldestTime) {
+			oldest, oldestTime = node, t
+		}
+	}
+	delete(times, oldest)
+}
+
+// take consumes one packet from the global airtime budget
+func (b *takBridge) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rate := float64(b.cfg.MaxPerMinute) / 60.0
+	b.tokens = min(float64(b.cfg.MaxPerMinute), b.tokens+now.Sub(b.lastRefill).Seconds()*rate)
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *takBridge) publishPosition(node uint32, ev *tak.CoTEvent, now time.Time) error {
+	lat := int32(ev.Point.Lat * 10_000_000)
+	lon := int32(ev.Point.Lon * 10_000_000)
+	alt := int32(ev.Point.Hae)
+
+	pos := &meshtastic.Position{
+		LatitudeI:      &lat,
+		LongitudeI:     &lon,
+		Altitude:       &alt,
+		Time:           uint32(now.Unix()),
+		LocationSource: meshtastic.Position_LOC_EXTERNAL,
+	}
+	if ev.Detail.Track != nil {
+		speed := uint32(ev.Detail.Track.Speed)
+		track := uint32(ev.Detail.Track.Course * 100)
+		pos.GroundSpeed = &speed
+		pos.GroundTrack = &track
+	}
+
+	payload, err := proto.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return b.publish(node, meshtastic.PortNum_POSITION_APP, payload)
+}
+
+func (b *takBridge) publishNodeInfo(node uint32, ev *tak.CoTEvent) error {
+	callsign := ev.Callsign()
+	shortName := callsign
+	if len([]rune(shortName)) > 4 {
+		shortName = string([]rune(shortName)[:4])
+	}
+
+	payload, err := proto.Marshal(&meshtastic.User{
+		Id:        fmt.Sprintf("!%08x", node),
+		LongName:  callsign,
+		ShortName: shortName,
+		HwModel:   meshtastic.HardwareModel_PRIVATE_HW,
+	})
+	if err != nil {
+		return err
+	}
+	return b.publish(node, meshtastic.PortNum_NODEINFO_APP, payload)
+}
+
+// publish encrypts a Data payload with the bridge channel key and sends it to the broker
+// wrapped in a ServiceEnvelope, the same way a Meshtastic gateway uplinks
+func (b *takBridge) publish(node uint32, portnum meshtastic.PortNum, payload []byte) error {
+	data, err := proto.Marshal(&meshtastic.Data{
+		Portnum: portnum,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	var idBytes [4]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return err
+	}
+	packetID := binary.LittleEndian.Uint32(idBytes[:])
+
+	encrypted, err := md.XOR(data, b.key.Hex, packetID, node)
+	if err != nil {
+		return err
+	}
+
+	gateway := fmt.Sprintf("!%08x", node)
+	envelope, err := proto.Marshal(&meshtastic.ServiceEnvelope{
+		Packet: &meshtastic.MeshPacket{
+			From:     node,
+			To:       meshBroadcastAddr,
+			Channel:  b.channelHash,
+			Id:       packetID,
+			HopLimit: b.cfg.HopLimit,
+			HopStart: b.cfg.HopLimit,
+			RxTime:   uint32(time.Now().Unix()),
+			ViaMqtt:  true,
+			Priority: meshtastic.MeshPacket_BACKGROUND,
+			PayloadVariant: &meshtastic.MeshPacket_Encrypted{
+				Encrypted: encrypted,
+			},
+		},
+		ChannelId: b.cfg.Channel,
+		GatewayId: gateway,
+	})
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("%s/%s/%s", b.cfg.TopicRoot, b.cfg.Channel, gateway)
+	return b.client.Publish(topic, 0, envelope)
+}
+
+// virtualNodeID derives a stable mesh node number from a TAK UID
+func virtualNodeID(uid string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(uid))
+	node := h.Sum32()
+	if node < meshFirstUsableNodeAddr || node == meshBroadcastAddr {
+		node ^= 0x80000000
+	}
+	return node
+}
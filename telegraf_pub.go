@@ -4,128 +4,39 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"gomqttenc/metrics"
 	"gomqttenc/parser"
-	"gomqttenc/rtl433"
 	"gomqttenc/shared"
+	"gomqttenc/transform"
 	"gomqttenc/utils"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/charmbracelet/log"
 )
 
+// channel tag of decoded packets whose topic does not name a channel
+const defaultChannel = "LongFast"
+
 // receive incoming telegraf Messages on the channel and publish to the Telegraf server
-func startPublisher(ctx context.Context, wg *sync.WaitGroup, telegrafURL string, telegrafChannel chan shared.TelegrafChannelMessage) {
+func startPublisher(ctx context.Context, wg *sync.WaitGroup, telegrafURL string, telegrafChannel chan shared.TelegrafChannelMessage, transformer *transform.Transformer) {
 	defer wg.Done()
 
 	for {
 
 		select {
 		case msg := <-telegrafChannel:
-			timestamp := time.Now().UnixNano()
-			var line string
-
-			switch metric := msg.(type) {
-			case parser.NodeInfoMessage:
-				if len(metric.PublicKey) > 0 {
-					line = fmt.Sprintf("device_metrics,device=%x,channel=LongFast,portnum=NODEINFO_APP "+
-						"id=\"%s\",long_name=\"%s\",short_name=\"%s\",macaddr=\"%-2.2x:%-2.2x:%-2.2x:%-2.2x:%-2.2x:%-2.2x\",hw_model=\"%s\",public_key=\"֡%x\"",
-						metric.Envelope.Device, metric.Id, metric.LongName, metric.ShortName,
-						metric.MACaddr[0], metric.MACaddr[1], metric.MACaddr[2], metric.MACaddr[3], metric.MACaddr[4], metric.MACaddr[5],
-						metric.HWModel, metric.PublicKey[0])
-				} else {
-					line = fmt.Sprintf("device_metrics,device=%x,channel=LongFast,portnum=NODEINFO_APP "+
-						"id=\"%s\",long_name=\"%s\",short_name=\"%s\",macaddr=\"%-2.2x:%-2.2x:%-2.2x:%-2.2x:%-2.2x:%-2.2x\",hw_model=\"%s\"",
-						metric.Envelope.Device, metric.Id, metric.LongName, metric.ShortName,
-						metric.MACaddr[0], metric.MACaddr[1], metric.MACaddr[2], metric.MACaddr[3], metric.MACaddr[4], metric.MACaddr[5],
-						metric.HWModel)
-				}
-
-			case parser.DeviceMetrics:
-				line = fmt.Sprintf("device_metrics,device=%x,channel=LongFast,portnum=TELEMETRY_APP "+
-					"battery_level=%d,voltage=%f,channel_utilization=%f,air_util_tx=%f,uptime_seconds=%d %d",
-					metric.Envelope.Device, metric.BatteryLevel, metric.Voltage,
-					metric.ChannelUtilization, metric.AirUtilTx, metric.UptimeSeconds, timestamp)
-
-			case parser.EnvironmentMetrics:
-				line = fmt.Sprintf("device_metrics,device=%x,channel=LongFast,portnum=TELEMETRY_APP "+
-					"temperature=%f,relative_humidity=%f %d",
-					metric.Envelope.Device, metric.Temperature, metric.RelativeHumidity, timestamp)
-
-			case parser.MapReportMessage:
-				line = fmt.Sprintf("device_metrics,device=%x,channel=LongFast,portnum=MAP_REPORT_APP "+
-					"long_name=\"%s\",short_name=\"%s\",HwModel=\"%s\",FirmwareVersion=\"%s\",Region=\"%s\",HasDefaultChannel=%t,LatitudeI=%d,LongitudeI=%d,Altitude=%d,PositionPrecision=%d,NumOnlineLocalNodes=%d %d",
-					metric.Envelope.Device, metric.LongName, metric.ShortName, metric.HwModel, metric.FirmwareVersion,
-					metric.Region, metric.HasDefaultChannel, metric.LatitudeI, metric.LongitudeI, metric.Altitude,
-					metric.PositionPrecision, metric.NumOnlineLocalNodes, timestamp)
-
-			case parser.PositionMessage:
-				var ts int64
-				var seq, sats int
-
-				if metric.Timestamp == nil {
-					ts = 0
-				} else {
-					ts = *metric.Timestamp
-				}
-				if metric.SeqNumber == nil {
-					seq = 0
-				} else {
-					seq = *metric.SeqNumber
-				}
-				if metric.SatsInView == nil {
-					sats = 0
-				} else {
-					sats = *metric.SatsInView
-				}
-
-				line = fmt.Sprintf("device_metrics,device=%x,channel=LongFast,portnum=POSITION_APP "+
-					"LatitudeI=%d,LongitudeI=%d,Altitude=%d,Time=%d,LocationSource=\"%s\",Timestamp=%d,SeqNumber=%d,SatsInView=%d,GroundSpeed=%d,GroundTrack=%d,PrecisionBits=%d %d",
-					metric.Envelope.Device,
-					metric.LatitudeI, metric.LongitudeI, metric.Altitude, metric.Time, metric.LocationSource, ts, seq, sats, metric.GroundSpeed, metric.GroundTrack, metric.PrecisionBits, timestamp)
-
-			case rtl433.RTL433SensorData:
-				line = fmt.Sprintf("rtl_433,model=\"%s\",ID=%s "+
-					"TemperatureC=%f,Humidity=%d,BatteryOK=%d,Status=%d,MIC=\"%s\" %d",
-					metric.Model, metric.ID, metric.TemperatureC, metric.Humidity, metric.BatteryOK, metric.Status, metric.MIC, timestamp)
-
-			case parser.DeepwoodBLE:
-				line = fmt.Sprintf("Intrusion,type=\"%s\",MAC=\"%s\" alert=\"%s\" %d", parser.DeepwoodBLEType, metric.MACAddr, parser.ALERT_DETECTED, timestamp)
-
-			case parser.DeepwoodWIFI:
-				line = fmt.Sprintf("Intrusion,type=\"%s\",MAC=\"%s\" alert=\"%s\" %d", parser.DeepwoodWIFIType, metric.MACAddr, parser.ALERT_DETECTED, timestamp)
-
-			case parser.DeepwoodProbe:
-				line = fmt.Sprintf("Intrusion,type=\"%s\",MAC=\"%s\" alert=\"%s\" %d", parser.DeepwoodProbeType, metric.MACAddr, parser.ALERT_DETECTED, timestamp)
-
-			default:
-				log.Error("Unknown Telegraf Channel Message Type received -- no message published: %T", msg)
-				return
-			}
-
-			// create and send request to the telegraf server
-			req, err := http.NewRequest("POST", telegrafURL, bytes.NewBuffer([]byte(line)))
-			if err != nil {
-				log.Error("Error creating request:", err)
+			// messages posted to TAK as well were transformed by their plugin
+			if done, ok := msg.(shared.Transformed); ok {
+				publishMessage(telegrafURL, done.Message)
 				continue
 			}
-			req.Header.Set("Content-Type", "text/plain")
 
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				log.Error("Error posting to Telegraf:", err)
-				continue
-			}
-			err = resp.Body.Close()
-			if err != nil {
-				log.Error("Error failed to close Request Body:", err)
-			}
-
-			if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
-				log.Infof("metric published to Telegraf: %s", utils.ReplaceBinaryWithHex(line))
-			} else {
-				log.Warnf("FAILED metric published to Telegraf Line: [%s], StatusCode: %d, Status: %s", utils.ReplaceBinaryWithHex(line), resp.StatusCode, resp.Status)
+			// the transform stage may drop the message or add points
+			for _, out := range transformer.Apply(msg) {
+				publishMessage(telegrafURL, out)
 			}
 
 		case <-ctx.Done():
@@ -134,3 +45,154 @@ func startPublisher(ctx context.Context, wg *sync.WaitGroup, telegrafURL string,
 		}
 	}
 }
+
+// publishMessage encodes msg in line protocol and posts it to the Telegraf server
+func publishMessage(telegrafURL string, msg shared.TelegrafChannelMessage) {
+	// a message reshaped by the transform stage must not stop the publisher
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("failed to encode %T, not published: %v", msg, r)
+		}
+	}()
+
+	timestamp := time.Now().UnixNano()
+	var line string
+
+	switch metric := msg.(type) {
+	case parser.NodeInfoMessage:
+		if len(metric.PublicKey) > 0 {
+			line = fmt.Sprintf("device_metrics,device=%x,portnum=NODEINFO_APP "+
+				"id=\"%s\",long_name=\"%s\",short_name=\"%s\",macaddr=\"%s\",hw_model=\"%s\",public_key=\"֡%x\"",
+				metric.Envelope.Device, metric.Id, metric.LongName, metric.ShortName,
+				macString(metric.MACaddr),
+				metric.HWModel, metric.PublicKey[0])
+		} else {
+			line = fmt.Sprintf("device_metrics,device=%x,portnum=NODEINFO_APP "+
+				"id=\"%s\",long_name=\"%s\",short_name=\"%s\",macaddr=\"%s\",hw_model=\"%s\"",
+				metric.Envelope.Device, metric.Id, metric.LongName, metric.ShortName,
+				macString(metric.MACaddr),
+				metric.HWModel)
+		}
+
+	case parser.DeviceMetrics:
+		line = fmt.Sprintf("device_metrics,device=%x,portnum=TELEMETRY_APP "+
+			"battery_level=%d,voltage=%f,channel_utilization=%f,air_util_tx=%f,uptime_seconds=%d %d",
+			metric.Envelope.Device, metric.BatteryLevel, metric.Voltage,
+			metric.ChannelUtilization, metric.AirUtilTx, metric.UptimeSeconds, timestamp)
+
+	case parser.EnvironmentMetrics:
+		line = fmt.Sprintf("device_metrics,device=%x,portnum=TELEMETRY_APP "+
+			"temperature=%f,relative_humidity=%f %d",
+			metric.Envelope.Device, metric.Temperature, metric.RelativeHumidity, timestamp)
+
+	case parser.MapReportMessage:
+		// reports without a position, or whose position was filtered, carry no coordinates
+		var position string
+		if metric.LatitudeI != 0 || metric.LongitudeI != 0 {
+			position = fmt.Sprintf(",LatitudeI=%d,LongitudeI=%d,Altitude=%d", metric.LatitudeI, metric.LongitudeI, metric.Altitude)
+		}
+		line = fmt.Sprintf("device_metrics,device=%x,portnum=MAP_REPORT_APP "+
+			"long_name=\"%s\",short_name=\"%s\",HwModel=\"%s\",FirmwareVersion=\"%s\",Region=\"%s\",HasDefaultChannel=%t%s,PositionPrecision=%d,NumOnlineLocalNodes=%d %d",
+			metric.Envelope.Device, metric.LongName, metric.ShortName, metric.HwModel, metric.FirmwareVersion,
+			metric.Region, metric.HasDefaultChannel, position,
+			metric.PositionPrecision, metric.NumOnlineLocalNodes, timestamp)
+
+	case parser.PositionMessage:
+		var ts int64
+		var seq, sats int
+
+		if metric.Timestamp == nil {
+			ts = 0
+		} else {
+			ts = *metric.Timestamp
+		}
+		if metric.SeqNumber == nil {
+			seq = 0
+		} else {
+			seq = *metric.SeqNumber
+		}
+		if metric.SatsInView == nil {
+			sats = 0
+		} else {
+			sats = *metric.SatsInView
+		}
+
+		line = fmt.Sprintf("device_metrics,device=%x,portnum=POSITION_APP "+
+			"LatitudeI=%d,LongitudeI=%d,Altitude=%d,Time=%d,LocationSource=\"%s\",Timestamp=%d,SeqNumber=%d,SatsInView=%d,GroundSpeed=%d,GroundTrack=%d,PrecisionBits=%d %d",
+			metric.Envelope.Device,
+			metric.LatitudeI, metric.LongitudeI, metric.Altitude, metric.Time, metric.LocationSource, ts, seq, sats, metric.GroundSpeed, metric.GroundTrack, metric.PrecisionBits, timestamp)
+
+	case metrics.Point:
+		var err error
+		line, err = metric.Line(time.Unix(0, timestamp))
+		if err != nil {
+			log.Errorf("invalid metric point: %s", err)
+			return
+		}
+
+	case parser.DeepwoodBLE:
+		line = fmt.Sprintf("Intrusion,type=\"%s\",MAC=\"%s\" alert=\"%s\" %d", parser.DeepwoodBLEType, metric.MACAddr, parser.ALERT_DETECTED, timestamp)
+
+	case parser.DeepwoodWIFI:
+		line = fmt.Sprintf("Intrusion,type=\"%s\",MAC=\"%s\" alert=\"%s\" %d", parser.DeepwoodWIFIType, metric.MACAddr, parser.ALERT_DETECTED, timestamp)
+
+	case parser.DeepwoodProbe:
+		line = fmt.Sprintf("Intrusion,type=\"%s\",MAC=\"%s\" alert=\"%s\" %d", parser.DeepwoodProbeType, metric.MACAddr, parser.ALERT_DETECTED, timestamp)
+
+	default:
+		log.Error("Unknown Telegraf Channel Message Type received -- no message published: %T", msg)
+		return
+	}
+
+	// topic parts and transform tags of a decoded packet
+	if env, ok := transform.Envelope(msg); ok {
+		line = metrics.AppendTags(line, lineTags(env))
+	}
+
+	// create and send request to the telegraf server
+	req, err := http.NewRequest("POST", telegrafURL, bytes.NewBuffer([]byte(line)))
+	if err != nil {
+		log.Error("Error creating request:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Error("Error posting to Telegraf:", err)
+		return
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		log.Error("Error failed to close Request Body:", err)
+	}
+
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		log.Infof("metric published to Telegraf: %s", utils.ReplaceBinaryWithHex(line))
+	} else {
+		log.Warnf("FAILED metric published to Telegraf Line: [%s], StatusCode: %d, Status: %s", utils.ReplaceBinaryWithHex(line), resp.StatusCode, resp.Status)
+	}
+}
+
+// lineTags returns the tags added to the line of a decoded message: the parts of its topic
+// and the tags set by the transform stage. Lines were tagged with the LongFast channel
+// before topics were parsed, kept when the topic does not name one.
+func lineTags(env parser.MessageEnvelope) map[string]string {
+	tags := env.TopicTags()
+	if tags["channel"] == "" {
+		tags["channel"] = defaultChannel
+	}
+	for k, v := range env.Tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// macString formats a MAC address as aa:bb:cc:dd:ee:ff, empty when the node did not send one
+func macString(mac []byte) string {
+	parts := make([]string, len(mac))
+	for i, b := range mac {
+		parts[i] = fmt.Sprintf("%-2.2x", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,411 @@
+package transform
+
+import (
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/parser"
+	"gomqttenc/shared"
+	"reflect"
+	"sort"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+const pointType = "Point"
+
+// portnum of the Meshtastic packets each message type is decoded from
+var portnums = map[string]string{
+	"NodeInfoMessage":    "NODEINFO_APP",
+	"MapReportMessage":   "MAP_REPORT_APP",
+	"PositionMessage":    "POSITION_APP",
+	"DeviceMetrics":      "TELEMETRY_APP",
+	"EnvironmentMetrics": "TELEMETRY_APP",
+	"DeepwoodBLE":        "TEXT_MESSAGE_APP",
+	"DeepwoodWIFI":       "TEXT_MESSAGE_APP",
+	"DeepwoodProbe":      "TEXT_MESSAGE_APP",
+}
+
+var envelopeType = reflect.TypeOf(parser.MessageEnvelope{})
+
+// Envelope returns the envelope of a decoded packet message
+func Envelope(msg shared.TelegrafChannelMessage) (parser.MessageEnvelope, bool) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Struct {
+		return parser.MessageEnvelope{}, false
+	}
+	env := v.FieldByName("Envelope")
+	if !env.IsValid() || env.Type() != envelopeType {
+		return parser.MessageEnvelope{}, false
+	}
+	return env.Interface().(parser.MessageEnvelope), true
+}
+
+func toStarlark(msg shared.TelegrafChannelMessage) (*starlark.Dict, error) {
+	d := starlark.NewDict(6)
+
+	if point, ok := msg.(metrics.Point); ok {
+		fields, err := mapToStarlark(point.Fields)
+		if err != nil {
+			return nil, err
+		}
+		ts := int64(0)
+		if !point.Time.IsZero() {
+			ts = point.Time.UnixNano()
+		}
+		setKey(d, "type", starlark.String(pointType))
+		setKey(d, "portnum", starlark.String(point.Tags["portnum"]))
+		setKey(d, "measurement", starlark.String(point.Measurement))
+		setKey(d, "tags", stringDict(point.Tags))
+		setKey(d, "fields", fields)
+		setKey(d, "time", starlark.MakeInt64(ts))
+		return d, nil
+	}
+
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Struct || !v.FieldByName("Envelope").IsValid() || v.FieldByName("Envelope").Type() != envelopeType {
+		return nil, fmt.Errorf("%T is not transformed", msg)
+	}
+	env := v.FieldByName("Envelope").Interface().(parser.MessageEnvelope)
+
+	envelope := starlark.NewDict(14)
+	setKey(envelope, "from", starlark.MakeUint64(uint64(env.From)))
+	setKey(envelope, "to", starlark.MakeUint64(uint64(env.To)))
+	setKey(envelope, "device", starlark.MakeUint64(uint64(env.Device)))
+	setKey(envelope, "topic", starlark.String(env.Topic))
+	setKey(envelope, "properties", stringDict(env.Properties))
+	setKey(envelope, "gateway", starlark.String(env.Gateway))
+	setKey(envelope, "rssi", starlark.MakeInt(env.RSSI))
+	setKey(envelope, "snr", starlark.Float(env.SNR))
+	setKey(envelope, "hops_away", starlark.MakeInt(env.HopsAway))
+	setKey(envelope, "region", starlark.String(env.Region))
+	setKey(envelope, "subregion", starlark.String(env.SubRegion))
+	setKey(envelope, "channel", starlark.String(env.Channel))
+	setKey(envelope, "format", starlark.String(env.Format))
+	if env.ChannelIndex != nil {
+		setKey(envelope, "channel_index", starlark.MakeInt(*env.ChannelIndex))
+	} else {
+		setKey(envelope, "channel_index", starlark.None)
+	}
+
+	fields := starlark.NewDict(v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() || f.Type == envelopeType {
+			continue
+		}
+		value, err := valueToStarlark(v.Field(i))
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", v.Type().Name(), f.Name, err)
+		}
+		setKey(fields, f.Name, value)
+	}
+
+	setKey(d, "type", starlark.String(v.Type().Name()))
+	setKey(d, "portnum", starlark.String(portnums[v.Type().Name()]))
+	setKey(d, "envelope", envelope)
+	setKey(d, "tags", stringDict(env.Tags))
+	setKey(d, "fields", fields)
+	return d, nil
+}
+
+// fromStarlark builds the message apply returned, starting from a copy of the original
+func fromStarlark(orig shared.TelegrafChannelMessage, value starlark.Value) (shared.TelegrafChannelMessage, error) {
+	d, ok := value.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("apply returned %s, want the message dict or None", value.Type())
+	}
+
+	if point, ok := orig.(metrics.Point); ok {
+		measurement := point.Measurement
+		ts := int64(0)
+		if !point.Time.IsZero() {
+			ts = point.Time.UnixNano()
+		}
+		if err := getKey(d, "measurement", &measurement); err != nil {
+			return nil, err
+		}
+		if err := getKey(d, "time", &ts); err != nil {
+			return nil, err
+		}
+		tags, _ := dictKey(d, "tags")
+		fields, _ := dictKey(d, "fields")
+		return toPoint(measurement, tags, fields, ts)
+	}
+
+	v := reflect.New(reflect.TypeOf(orig)).Elem()
+	v.Set(reflect.ValueOf(orig))
+	env := v.FieldByName("Envelope").Addr().Interface().(*parser.MessageEnvelope)
+
+	if envelope, ok := dictKey(d, "envelope"); ok {
+		for key, field := range map[string]string{
+			"from": "From", "to": "To", "device": "Device", "topic": "Topic", "properties": "Properties",
+			"gateway": "Gateway", "rssi": "RSSI", "snr": "SNR", "hops_away": "HopsAway",
+			"region": "Region", "subregion": "SubRegion", "channel": "Channel", "format": "Format",
+			"channel_index": "ChannelIndex",
+		} {
+			value, found, err := envelope.Get(starlark.String(key))
+			if err != nil || !found {
+				continue
+			}
+			if err := assign(reflect.ValueOf(env).Elem().FieldByName(field), value); err != nil {
+				return nil, fmt.Errorf("envelope %s: %w", key, err)
+			}
+		}
+	}
+
+	if tags, ok := dictKey(d, "tags"); ok {
+		m, err := stringMap(tags)
+		if err != nil {
+			return nil, fmt.Errorf("tags: %w", err)
+		}
+		env.Tags = m
+	}
+
+	if fields, ok := dictKey(d, "fields"); ok {
+		for _, item := range fields.Items() {
+			name, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("field name %s is not a string", item[0])
+			}
+			f := v.FieldByName(name)
+			if !f.IsValid() || !f.CanSet() || f.Type() == envelopeType {
+				return nil, fmt.Errorf("%s has no field %s", v.Type().Name(), name)
+			}
+			if err := assign(f, item[1]); err != nil {
+				return nil, fmt.Errorf("field %s: %w", name, err)
+			}
+		}
+	}
+
+	return v.Interface(), nil
+}
+
+func toPoint(measurement string, tags, fields *starlark.Dict, ts int64) (metrics.Point, error) {
+	point := metrics.Point{Measurement: measurement}
+	if ts != 0 {
+		point.Time = time.Unix(0, ts)
+	}
+
+	if tags != nil {
+		m, err := stringMap(tags)
+		if err != nil {
+			return point, fmt.Errorf("tags: %w", err)
+		}
+		point.Tags = m
+	}
+
+	if fields != nil {
+		point.Fields = make(map[string]interface{}, fields.Len())
+		for _, item := range fields.Items() {
+			name, ok := starlark.AsString(item[0])
+			if !ok {
+				return point, fmt.Errorf("field name %s is not a string", item[0])
+			}
+			switch x := item[1].(type) {
+			case starlark.Int:
+				i, ok := x.Int64()
+				if !ok {
+					return point, fmt.Errorf("field %s overflows int64", name)
+				}
+				point.Fields[name] = i
+			case starlark.Float:
+				point.Fields[name] = float64(x)
+			case starlark.String:
+				point.Fields[name] = string(x)
+			case starlark.Bool:
+				point.Fields[name] = bool(x)
+			default:
+				return point, fmt.Errorf("field %s is a %s, want int, float, string or bool", name, x.Type())
+			}
+		}
+	}
+
+	return point, nil
+}
+
+func valueToStarlark(v reflect.Value) (starlark.Value, error) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return starlark.None, nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return starlark.None, nil
+		}
+		return valueToStarlark(v.Elem())
+	case reflect.String:
+		return starlark.String(v.String()), nil
+	case reflect.Bool:
+		return starlark.Bool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return starlark.MakeInt64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return starlark.MakeUint64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return starlark.Float(v.Float()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return starlark.Bytes(v.Bytes()), nil
+		}
+	case reflect.Map:
+		if m, ok := v.Interface().(map[string]string); ok {
+			return stringDict(m), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// assign sets a Go value from a Starlark one, converting between compatible kinds
+func assign(f reflect.Value, value starlark.Value) error {
+	if value == starlark.None {
+		switch f.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			f.Set(reflect.Zero(f.Type()))
+			return nil
+		}
+		return fmt.Errorf("%s cannot be None", f.Type())
+	}
+
+	switch f.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(f.Type().Elem())
+		if err := assign(p.Elem(), value); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	case reflect.String:
+		if s, ok := starlark.AsString(value); ok {
+			f.SetString(s)
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := value.(starlark.Bool); ok {
+			f.SetBool(bool(b))
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := value.(starlark.Int); ok {
+			n, ok := i.Int64()
+			if !ok || f.OverflowInt(n) {
+				return fmt.Errorf("%s overflows %s", i, f.Type())
+			}
+			f.SetInt(n)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := value.(starlark.Int); ok {
+			n, ok := i.Uint64()
+			if !ok || f.OverflowUint(n) {
+				return fmt.Errorf("%s overflows %s", i, f.Type())
+			}
+			f.SetUint(n)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if x, ok := starlark.AsFloat(value); ok {
+			f.SetFloat(x)
+			return nil
+		}
+	case reflect.Slice:
+		if f.Type().Elem().Kind() == reflect.Uint8 {
+			switch b := value.(type) {
+			case starlark.Bytes:
+				f.SetBytes([]byte(b))
+				return nil
+			case starlark.String:
+				f.SetBytes([]byte(b))
+				return nil
+			}
+		}
+	case reflect.Map:
+		if d, ok := value.(*starlark.Dict); ok && f.Type() == reflect.TypeOf(map[string]string{}) {
+			m, err := stringMap(d)
+			if err != nil {
+				return err
+			}
+			f.Set(reflect.ValueOf(m))
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot assign %s to %s", value.Type(), f.Type())
+}
+
+func mapToStarlark(m map[string]interface{}) (*starlark.Dict, error) {
+	d := starlark.NewDict(len(m))
+	for _, k := range sortedKeys(m) {
+		value, err := valueToStarlark(reflect.ValueOf(m[k]))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", k, err)
+		}
+		setKey(d, k, value)
+	}
+	return d, nil
+}
+
+func stringDict(m map[string]string) *starlark.Dict {
+	d := starlark.NewDict(len(m))
+	for _, k := range sortedKeys(m) {
+		setKey(d, k, starlark.String(m[k]))
+	}
+	return d
+}
+
+func stringMap(d *starlark.Dict) (map[string]string, error) {
+	m := make(map[string]string, d.Len())
+	for _, item := range d.Items() {
+		k, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("key %s is not a string", item[0])
+		}
+		v, ok := starlark.AsString(item[1])
+		if !ok {
+			v = item[1].String()
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+func setKey(d *starlark.Dict, key string, value starlark.Value) {
+	// SetKey only fails on frozen dicts and unhashable keys
+	_ = d.SetKey(starlark.String(key), value)
+}
+
+func dictKey(d *starlark.Dict, key string) (*starlark.Dict, bool) {
+	value, found, err := d.Get(starlark.String(key))
+	if err != nil || !found {
+		return nil, false
+	}
+	sub, ok := value.(*starlark.Dict)
+	return sub, ok
+}
+
+func getKey(d *starlark.Dict, key string, ptr interface{}) error {
+	value, found, err := d.Get(starlark.String(key))
+	if err != nil || !found {
+		return nil
+	}
+	switch p := ptr.(type) {
+	case *string:
+		s, ok := starlark.AsString(value)
+		if !ok {
+			return fmt.Errorf("%s is a %s, want string", key, value.Type())
+		}
+		*p = s
+	case *int64:
+		if err := starlark.AsInt(value, p); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,242 @@
+// Package transform runs a Starlark script on every message before it reaches its sinks.
+// Messages exported to Telegraf only are transformed by the publisher, plugins posting a
+// message to TAK as well run the script first (shared.ApplyTransform), so a message the
+// script drops or changes is dropped or changed in TAK too. The script defines apply(msg)
+// where msg is a dict, for decoded packets
+//
+//	{"type": "PositionMessage", "portnum": "POSITION_APP",
+//	 "envelope": {"from": 2712847316, "to": 4294967295, "device": 2712847316, "topic": "msh/US/2/e/LongFast/!a1b2c3d4", "properties": {},
+//	              "gateway": "!a1b2c3d4", "rssi": -92, "snr": 6.5, "hops_away": 1,
+//	              "region": "US", "subregion": "", "channel": "LongFast", "format": "e", "channel_index": None},
+//	 "tags": {}, "fields": {"LatitudeI": 377749000, "LongitudeI": -1224194000, ...}}
+//
+// and for metric points
+//
+//	{"type": "Point", "portnum": "", "measurement": "rtl_433", "tags": {...}, "fields": {...}, "time": 1700000000000000000}
+//
+// apply returns the message, changed or not, or None to drop it. Decoded packet fields keep
+// their Go names and types, tags are added to the published line. emit(measurement, tags,
+// fields, time) sends an extra point. Scripts cannot load modules or reach the filesystem,
+// each call is bounded in time and execution steps. A script failing on a message lets it
+// through unchanged.
+package transform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gomqttenc/metrics"
+	"gomqttenc/shared"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	DefaultTimeout        = 100
+	DefaultMaxSteps       = 1_000_000
+	DefaultReloadInterval = 5
+
+	applyFunc  = "apply"
+	emittedKey = "emitted"
+)
+
+var ErrNoApply = errors.New("script does not define apply(msg)")
+
+var fileOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+}
+
+// Transformer holds the loaded script, swapped atomically on reload
+type Transformer struct {
+	script         string
+	timeout        time.Duration
+	maxSteps       uint64
+	reloadInterval time.Duration
+
+	apply   atomic.Pointer[starlark.Function]
+	modTime time.Time
+}
+
+// New loads the script of cfg. Without a script it returns nil, a nil Transformer passes
+// every message through.
+func New(cfg shared.TransformConfig) (*Transformer, error) {
+	if cfg.Script == "" {
+		return nil, nil
+	}
+
+	t := &Transformer{
+		script:         cfg.Script,
+		timeout:        time.Duration(cfg.Timeout) * time.Millisecond,
+		maxSteps:       cfg.MaxSteps,
+		reloadInterval: time.Duration(cfg.ReloadInterval) * time.Second,
+	}
+	if cfg.Timeout <= 0 {
+		t.timeout = DefaultTimeout * time.Millisecond
+	}
+	if cfg.MaxSteps == 0 {
+		t.maxSteps = DefaultMaxSteps
+	}
+	if cfg.ReloadInterval <= 0 {
+		t.reloadInterval = DefaultReloadInterval * time.Second
+	}
+
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	log.Infof("transform: loaded [%s], timeout [%s], max steps [%d]", t.script, t.timeout, t.maxSteps)
+	return t, nil
+}
+
+func (t *Transformer) load() error {
+	info, err := os.Stat(t.script)
+	if err != nil {
+		return err
+	}
+	src, err := os.ReadFile(t.script)
+	if err != nil {
+		return err
+	}
+	t.modTime = info.ModTime()
+
+	thread := t.newThread()
+	timer := time.AfterFunc(t.timeout, func() { thread.Cancel("timeout") })
+	globals, err := starlark.ExecFileOptions(fileOptions, thread, t.script, src, starlark.StringDict{
+		"emit": starlark.NewBuiltin("emit", emit),
+	})
+	timer.Stop()
+	if err != nil {
+		return fmt.Errorf("transform [%s]: %w", t.script, err)
+	}
+
+	apply, ok := globals[applyFunc].(*starlark.Function)
+	if !ok {
+		return fmt.Errorf("transform [%s]: %w", t.script, ErrNoApply)
+	}
+	globals.Freeze()
+	t.apply.Store(apply)
+	return nil
+}
+
+// Watch reloads the script whenever it changes on disk until ctx is cancelled. A script
+// that fails to load leaves the previous one in place.
+func (t *Transformer) Watch(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	ticker := time.NewTicker(t.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(t.script)
+			if err != nil {
+				log.Warnf("transform: %s", err)
+				continue
+			}
+			if info.ModTime().Equal(t.modTime) {
+				continue
+			}
+			if err := t.load(); err != nil {
+				log.Errorf("transform: reload failed, keeping the previous script: %s", err)
+				continue
+			}
+			log.Infof("transform: reloaded [%s]", t.script)
+		}
+	}
+}
+
+// Apply runs the script on msg and returns what to publish: nothing when the script
+// dropped it, the message as changed by the script and the points it emitted
+func (t *Transformer) Apply(msg shared.TelegrafChannelMessage) []shared.TelegrafChannelMessage {
+	changed, ok, emitted := t.Run(msg)
+
+	out := make([]shared.TelegrafChannelMessage, 0, 1+len(emitted))
+	if ok {
+		out = append(out, changed)
+	}
+	for _, point := range emitted {
+		out = append(out, point)
+	}
+	return out
+}
+
+// Run runs the script on msg and returns the message as changed by the script, false when
+// the script dropped it, and the points it emitted
+func (t *Transformer) Run(msg shared.TelegrafChannelMessage) (shared.TelegrafChannelMessage, bool, []metrics.Point) {
+	if t == nil {
+		return msg, true, nil
+	}
+
+	value, err := toStarlark(msg)
+	if err != nil {
+		log.Debugf("transform: %s", err)
+		return msg, true, nil
+	}
+
+	var emitted []metrics.Point
+	thread := t.newThread()
+	thread.SetLocal(emittedKey, &emitted)
+
+	timer := time.AfterFunc(t.timeout, func() { thread.Cancel("timeout") })
+	result, err := starlark.Call(thread, t.apply.Load(), starlark.Tuple{value}, nil)
+	timer.Stop()
+	if err != nil {
+		log.Errorf("transform: %s, message passed unchanged", err)
+		return msg, true, nil
+	}
+
+	if result == starlark.None {
+		log.Debugf("transform: dropped %T", msg)
+		return nil, false, emitted
+	}
+	changed, err := fromStarlark(msg, result)
+	if err != nil {
+		log.Errorf("transform: %s, message passed unchanged", err)
+		changed = msg
+	}
+	return changed, true, emitted
+}
+
+func (t *Transformer) newThread() *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: "transform",
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Infof("transform: %s", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(t.maxSteps)
+	return thread
+}
+
+// emit(measurement, tags=None, fields=None, time=0) queues an extra point
+func emit(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var measurement string
+	var tags, fields *starlark.Dict
+	var ts int64
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "measurement", &measurement, "tags?", &tags, "fields?", &fields, "time?", &ts); err != nil {
+		return nil, err
+	}
+
+	emitted, ok := thread.Local(emittedKey).(*[]metrics.Point)
+	if !ok {
+		return nil, fmt.Errorf("%s: only callable from apply", fn.Name())
+	}
+
+	point, err := toPoint(measurement, tags, fields, ts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	*emitted = append(*emitted, point)
+	return starlark.None, nil
+}
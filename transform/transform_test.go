@@ -0,0 +1,117 @@
+package transform
+
+import (
+	"gomqttenc/metrics"
+	"gomqttenc/parser"
+	"gomqttenc/shared"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadScript(t *testing.T, src string) *Transformer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "transform.star")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := New(shared.TransformConfig{Script: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func position(from uint32, lat int) parser.PositionMessage {
+	return parser.PositionMessage{
+		Envelope:  parser.MessageEnvelope{From: from},
+		LatitudeI: lat,
+	}
+}
+
+func TestRun(t *testing.T) {
+	tr := loadScript(t, `
+def apply(msg):
+    if msg["type"] == "PositionMessage":
+        if msg["envelope"]["from"] == 1:
+            return None
+        msg["fields"]["LatitudeI"] = msg["fields"]["LatitudeI"] // 1000 * 1000
+        emit("seen", tags = {"node": str(msg["envelope"]["from"])}, fields = {"count": 1})
+    return msg
+`)
+
+	if _, ok, _ := tr.Run(position(1, 377749123)); ok {
+		t.Error("position of node 1 not dropped")
+	}
+
+	changed, ok, emitted := tr.Run(position(2, 377749123))
+	if !ok {
+		t.Fatal("position of node 2 dropped")
+	}
+	if pos, isPos := changed.(parser.PositionMessage); !isPos || pos.LatitudeI != 377749000 {
+		t.Errorf("changed %+v, want the latitude rounded", changed)
+	}
+	if len(emitted) != 1 || emitted[0].Measurement != "seen" || emitted[0].Tags["node"] != "2" {
+		t.Errorf("emitted %+v, want one seen point", emitted)
+	}
+
+	// a nil Transformer passes every message through
+	var none *Transformer
+	if msg, ok, emitted := none.Run(position(1, 5)); !ok || msg.(parser.PositionMessage).LatitudeI != 5 || emitted != nil {
+		t.Errorf("nil transformer: %+v %v %+v", msg, ok, emitted)
+	}
+}
+
+func TestApplyTransformBeforeSinks(t *testing.T) {
+	tr := loadScript(t, `
+def apply(msg):
+    emit("extra")
+    if msg["envelope"]["from"] == 1:
+        return None
+    return msg
+`)
+	telegraf := make(chan shared.TelegrafChannelMessage, 4)
+
+	if _, ok := shared.ApplyTransform(tr, position(1, 0), telegraf); ok {
+		t.Error("dropped message reported as kept")
+	}
+	if _, ok := shared.ApplyTransform(tr, position(2, 0), telegraf); !ok {
+		t.Error("kept message reported as dropped")
+	}
+
+	// the emitted points are sent marked as transformed so the publisher does not run the
+	// script on them again
+	if len(telegraf) != 2 {
+		t.Fatalf("%d points sent, want 2", len(telegraf))
+	}
+	for range 2 {
+		done, ok := (<-telegraf).(shared.Transformed)
+		if !ok {
+			t.Fatal("emitted point not marked as transformed")
+		}
+		if point, ok := done.Message.(metrics.Point); !ok || point.Measurement != "extra" {
+			t.Errorf("emitted %+v", done.Message)
+		}
+	}
+}
+
+func TestExampleScript(t *testing.T) {
+	tr, err := New(shared.TransformConfig{Script: "../transform.star"})
+	if err != nil {
+		t.Fatalf("example script: %s", err)
+	}
+
+	if _, ok, _ := tr.Run(position(1, 5)); !ok {
+		t.Error("example script dropped a position")
+	}
+
+	point := metrics.Point{
+		Measurement: "rtl_433",
+		Tags:        map[string]string{"model": "Acurite-5n1", "id": "1234"},
+		Fields:      map[string]interface{}{"battery_ok": 0},
+	}
+	_, ok, emitted := tr.Run(point)
+	if !ok || len(emitted) != 1 || emitted[0].Measurement != "sensor_alert" {
+		t.Errorf("low battery event: kept %v, emitted %+v", ok, emitted)
+	}
+}
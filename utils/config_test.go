@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"gomqttenc/shared"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, config string) (*shared.Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestLoadConfigPluginLists(t *testing.T) {
+	cfg, err := loadTestConfig(t, `{
+		"broker": "tcp://localhost:1883",
+		"topics": {
+			"msh/#": {"name": "msh", "qos": 0},
+			"weather/+/state": [{"name": "json", "qos": 0}, {"name": "py-weather", "qos": 1, "options": {"unit": "C"}}]
+		},
+		"brokers": [{
+			"name": "second",
+			"url": "tcp://localhost:1884",
+			"topics": {
+				"weather/+/state": [{"name": "json", "qos": 2}, {"name": "archive", "qos": 0}],
+				"rtl_433/+/events": {"name": "rtl433", "qos": 0}
+			}
+		}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weather := cfg.Topics["weather/+/state"]
+	if len(weather) != 2 || weather[0].Name != "json" || weather[1].Name != "py-weather" {
+		t.Fatalf("weather/+/state plugins %+v, want json and py-weather", weather)
+	}
+	if string(weather[1].Options) != `{"unit": "C"}` {
+		t.Errorf("py-weather options %s", weather[1].Options)
+	}
+	if len(cfg.Topics["msh/#"]) != 1 || cfg.Topics["msh/#"][0].Name != "msh" {
+		t.Errorf("msh/# plugins %+v, want msh", cfg.Topics["msh/#"])
+	}
+
+	qos := TopicsQoSFromConfig(cfg.Topics)
+	if qos["weather/+/state"] != 1 || qos["msh/#"] != 0 {
+		t.Errorf("QoS %v, want the highest QoS of each filter", qos)
+	}
+
+	// the plugins of a filter listed by several tables are merged, first config wins
+	local := LocalTopics(cfg)
+	var names []string
+	for _, p := range local["weather/+/state"] {
+		names = append(names, p.Name)
+	}
+	if want := []string{"json", "py-weather", "archive"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("local weather/+/state plugins %v, want %v", names, want)
+	}
+	if local["weather/+/state"][0].QoS != 0 {
+		t.Errorf("json plugin QoS %d, want the first config", local["weather/+/state"][0].QoS)
+	}
+	if len(local["rtl_433/+/events"]) != 1 {
+		t.Errorf("local rtl_433/+/events plugins %+v", local["rtl_433/+/events"])
+	}
+}
+
+func TestLoadConfigEmptyPluginList(t *testing.T) {
+	_, err := loadTestConfig(t, `{"broker": "tcp://localhost:1883", "topics": {"msh/#": []}}`)
+	if err == nil {
+		t.Fatal("empty plugin list accepted")
+	}
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+)
+
+const sharePrefix = "$share/"
+
+// StripSharePrefix removes the $share/<group>/ prefix of a shared subscription filter
+func StripSharePrefix(filter string) string {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return filter
+	}
+	rest := strings.TrimPrefix(filter, sharePrefix)
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return rest[i+1:]
+	}
+	return rest
+}
+
+// TopicMatches reports whether a topic matches a subscription filter following the MQTT
+// rules: + matches one level, a trailing # matches the parent level and everything below
+// it, and wildcards in the first level never match topics starting with $
+func TopicMatches(subscription, received string) bool {
+	filter := strings.Split(StripSharePrefix(subscription), "/")
+	topic := strings.Split(received, "/")
+
+	if strings.HasPrefix(received, "$") && (filter[0] == "+" || filter[0] == "#") {
+		return false
+	}
+
+	for i, level := range filter {
+		if level == "#" {
+			return i == len(filter)-1
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if level != "+" && level != topic[i] {
+			return false
+		}
+	}
+	return len(filter) == len(topic)
+}
+
+// TopicMatch is a value whose filter matched a topic
+type TopicMatch[T any] struct {
+	Filter string
+	Value  T
+}
+
+// TopicTrie maps subscription filters to values. Match returns every value whose filter
+// matches a topic, the most specific filter first.
+type TopicTrie[T any] struct {
+	root *topicNode[T]
+}
+
+type topicNode[T any] struct {
+	children map[string]*topicNode[T]
+	entries  []TopicMatch[T]
+}
+
+func NewTopicTrie[T any]() *TopicTrie[T] {
+	return &TopicTrie[T]{root: newTopicNode[T]()}
+}
+
+func newTopicNode[T any]() *topicNode[T] {
+	return &topicNode[T]{children: make(map[string]*topicNode[T])}
+}
+
+// Add registers value for filter. A filter may hold several values, they are matched in
+// the order they were added.
+func (t *TopicTrie[T]) Add(filter string, value T) {
+	node := t.root
+	for _, level := range strings.Split(StripSharePrefix(filter), "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode[T]()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.entries = append(node.entries, TopicMatch[T]{Filter: filter, Value: value})
+}
+
+// Match returns the values of every filter matching topic in precedence order
+func (t *TopicTrie[T]) Match(topic string) []TopicMatch[T] {
+	levels := strings.Split(topic, "/")
+	dollar := strings.HasPrefix(topic, "$")
+
+	var matches []TopicMatch[T]
+	var walk func(node *topicNode[T], i int)
+	walk = func(node *topicNode[T], i int) {
+		wildcards := i > 0 || !dollar
+
+		// # also matches the parent level, a/# matches a
+		if child, ok := node.children["#"]; ok && wildcards {
+			matches = append(matches, child.entries...)
+		}
+		if i == len(levels) {
+			matches = append(matches, node.entries...)
+			return
+		}
+		if child, ok := node.children[levels[i]]; ok {
+			walk(child, i+1)
+		}
+		if child, ok := node.children["+"]; ok && wildcards {
+			walk(child, i+1)
+		}
+	}
+	walk(t.root, 0)
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return filterLess(matches[i].Filter, matches[j].Filter)
+	})
+	return matches
+}
+
+// filterLess orders filters from the most to the least specific. Levels are compared
+// left to right, a literal level beats + which beats #, and a longer filter beats a
+// shorter one. Equally specific filters are ordered by name.
+func filterLess(a, b string) bool {
+	la := strings.Split(StripSharePrefix(a), "/")
+	lb := strings.Split(StripSharePrefix(b), "/")
+
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if ra, rb := levelRank(la[i]), levelRank(lb[i]); ra != rb {
+			return ra < rb
+		}
+	}
+	if len(la) != len(lb) {
+		return len(la) > len(lb)
+	}
+	return a < b
+}
+
+func levelRank(level string) int {
+	switch level {
+	case "#":
+		return 2
+	case "+":
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"msh/US/2/e/LongFast/!a1b2c3d4", "msh/US/2/e/LongFast/!a1b2c3d4", true},
+		{"msh/US/2/e/LongFast", "msh/US/2/e/LongFast/!a1b2c3d4", false},
+		{"msh/US/2/e/LongFast/!a1b2c3d4", "msh/US/2/e/LongFast", false},
+
+		// + matches exactly one level
+		{"msh/+/2/e/+/+", "msh/US/2/e/LongFast/!a1b2c3d4", true},
+		{"msh/+", "msh/US", true},
+		{"msh/+", "msh/US/2", false},
+		{"msh/+", "msh", false},
+		{"msh/+", "msh/", true},
+		{"+/+", "/msh", true},
+		{"+", "msh", true},
+
+		// # matches any number of levels, the parent level included
+		{"msh/#", "msh/US/2/e/LongFast/!a1b2c3d4", true},
+		{"msh/#", "msh/US", true},
+		{"msh/#", "msh", true},
+		{"msh/US/#", "msh", false},
+		{"msh/#", "mshx/US", false},
+		{"#", "msh/US", true},
+		{"msh/+/2/#", "msh/US/2/json/LongFast/!a1", true},
+		{"msh/+/2/#", "msh/US/3/json", false},
+
+		// wildcards in the first level never match $ topics
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+
+		// shared subscriptions match without their $share/<group>/ prefix
+		{"$share/gomqttenc/msh/#", "msh/US/2/e/LongFast/!a1", true},
+		{"$share/gomqttenc/msh/+/2/stat/+", "msh/US/2/stat/!a1", true},
+		{"$share/gomqttenc/msh/EU/#", "msh/US/2/e/LongFast/!a1", false},
+	}
+
+	for _, tt := range tests {
+		if got := TopicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestStripSharePrefix(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"msh/#", "msh/#"},
+		{"$share/group/msh/#", "msh/#"},
+		{"$share/group/#", "#"},
+		{"$share/group", "group"},
+		{"$SYS/#", "$SYS/#"},
+	}
+
+	for _, tt := range tests {
+		if got := StripSharePrefix(tt.filter); got != tt.want {
+			t.Errorf("StripSharePrefix(%q) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestTopicTrieMatch(t *testing.T) {
+	filters := []string{
+		"#",
+		"msh/#",
+		"msh/+/2/e/+/+",
+		"msh/US/#",
+		"msh/US/2/e/LongFast/!a1b2c3d4",
+		"msh/US/2/e/+/#",
+		"msh/+/#",
+		"$share/group/msh/US/2/stat/+",
+		"$SYS/#",
+		"rtl_433/+/events",
+	}
+	trie := NewTopicTrie[string]()
+	for _, f := range filters {
+		trie.Add(f, f)
+	}
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{
+			// most specific first: literal levels beat + which beats #, longer beats shorter
+			topic: "msh/US/2/e/LongFast/!a1b2c3d4",
+			want: []string{
+				"msh/US/2/e/LongFast/!a1b2c3d4",
+				"msh/US/2/e/+/#",
+				"msh/US/#",
+				"msh/+/2/e/+/+",
+				"msh/+/#",
+				"msh/#",
+				"#",
+			},
+		},
+		{
+			topic: "msh/US/2/stat/!a1",
+			want:  []string{"$share/group/msh/US/2/stat/+", "msh/US/#", "msh/+/#", "msh/#", "#"},
+		},
+		{
+			// a/# matches its parent level a
+			topic: "msh",
+			want:  []string{"msh/#", "#"},
+		},
+		{
+			topic: "msh/EU",
+			want:  []string{"msh/+/#", "msh/#", "#"},
+		},
+		{
+			topic: "$SYS/broker/uptime",
+			want:  []string{"$SYS/#"},
+		},
+		{
+			topic: "rtl_433/collector/events",
+			want:  []string{"rtl_433/+/events", "#"},
+		},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, m := range trie.Match(tt.topic) {
+			if m.Filter != m.Value {
+				t.Errorf("Match(%q): filter %q holds value %q", tt.topic, m.Filter, m.Value)
+			}
+			got = append(got, m.Filter)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) =\n  %q\nwant\n  %q", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestTopicTrieMatchesLikeTopicMatches(t *testing.T) {
+	filters := []string{"#", "+", "+/+", "a/#", "a/+", "a/+/c", "a/b/#", "+/b/+", "$SYS/#", "$share/g/a/#"}
+	topics := []string{"a", "a/b", "a/b/c", "a/x/c", "x/b/y", "/", "a/", "$SYS/x", "$SYS"}
+
+	trie := NewTopicTrie[string]()
+	for _, f := range filters {
+		trie.Add(f, f)
+	}
+
+	for _, topic := range topics {
+		matched := make(map[string]bool)
+		for _, m := range trie.Match(topic) {
+			matched[m.Filter] = true
+		}
+		for _, f := range filters {
+			if want := TopicMatches(f, topic); matched[f] != want {
+				t.Errorf("topic %q filter %q: trie matched %v, TopicMatches %v", topic, f, matched[f], want)
+			}
+		}
+	}
+}
+
+func TestFilterLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/+", true},
+		{"a/+", "a/#", true},
+		{"a/b", "a/#", true},
+		{"a/b/c", "a/b", true},
+		{"a/+/c", "a/+", true},
+		{"a/b/#", "a/+/c", true},
+		{"$share/g/a/b", "a/+", true},
+		{"a/b", "a/c", true},
+		{"a/c", "a/b", false},
+		{"a/#", "a/+", false},
+	}
+
+	for _, tt := range tests {
+		if got := filterLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("filterLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
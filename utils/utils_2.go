@@ -11,11 +11,13 @@ import (
 	"github.com/charmbracelet/log"
 )
 
-func TopicsQoSFromConfig(cfg map[string]shared.PluginConfig) map[string]byte {
+const DefaultBrokerName = "default"
+
+func TopicsQoSFromConfig(cfg map[string]shared.PluginConfigs) map[string]byte {
 	var transformed = make(map[string]byte)
 
-	for topic, plug := range cfg {
-		transformed[topic] = plug.QoS
+	for topic, plugs := range cfg {
+		transformed[topic] = plugs.QoS()
 	}
 
 	return transformed
@@ -37,29 +39,67 @@ func LoadConfig(filename string) (*shared.Config, error) {
 	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
 		return nil, err
 	}
-	return &cfg, nil
-}
 
-// topicMatches returns true if the received topic matches the subscription topic
-func TopicMatches(subscription, received string) bool {
-	// Case 1: No wildcard, exact match only
-	if !strings.HasSuffix(subscription, "#") {
-		return subscription == received
+	// the legacy single broker settings become the first broker definition
+	if cfg.Broker != "" {
+		legacy := shared.BrokerConfig{
+			Name:     DefaultBrokerName,
+			URL:      cfg.Broker,
+			ClientID: cfg.ClientID,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			TLS:      cfg.BrokerTLS,
+			Session:  cfg.BrokerSession,
+			Topics:   cfg.Topics,
+		}
+		cfg.Brokers = append([]shared.BrokerConfig{legacy}, cfg.Brokers...)
 	}
 
-	// Case 2: Wildcard '#'
-	// Remove "/#" or just "#" from subscription
-	if subscription == "#" {
-		return true // Matches everything
+	names := make(map[string]bool)
+	for i := range cfg.Brokers {
+		b := &cfg.Brokers[i]
+		if b.URL == "" {
+			return nil, fmt.Errorf("broker [%d] has no url", i)
+		}
+		if b.Name == "" {
+			b.Name = b.URL
+		}
+		if names[b.Name] {
+			return nil, fmt.Errorf("duplicate broker name [%s]", b.Name)
+		}
+		names[b.Name] = true
+		if len(b.Topics) == 0 {
+			return nil, fmt.Errorf("no topics listed for broker [%s]", b.Name)
+		}
 	}
 
-	if strings.HasSuffix(subscription, "/#") {
-		prefix := strings.TrimSuffix(subscription, "/#")
-		return received == prefix || strings.HasPrefix(received, prefix+"/")
+	return &cfg, nil
+}
+
+// LocalTopics returns the topic table used for non-MQTT inputs, the top level topics
+// followed by the topics of every broker. A filter listed in several tables runs the
+// plugins of all of them, a plugin name listed twice for a filter keeps its first config.
+func LocalTopics(cfg *shared.Config) map[string]shared.PluginConfigs {
+	topics := make(map[string]shared.PluginConfigs)
+	add := func(table map[string]shared.PluginConfigs) {
+		for t, plugs := range table {
+		next:
+			for _, p := range plugs {
+				for _, prev := range topics[t] {
+					if prev.Name == p.Name {
+						continue next
+					}
+				}
+				topics[t] = append(topics[t], p)
+			}
+		}
 	}
 
-	// Unsupported wildcard usage (e.g., '#' not at end)
-	return false
+	add(cfg.Topics)
+	for _, b := range cfg.Brokers {
+		add(b.Topics)
+	}
+	return topics
 }
 
 func GetRootTopic(topic string) string {